@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gazoon/go-utils"
+)
+
+func main() {
+	configDir := flag.String("dir", "config", "config directory")
+	leftEnv := flag.String("from", "staging", "environment to compare from")
+	rightEnv := flag.String("to", "prod", "environment to compare to")
+	manifest := flag.String("manifest", "", "environments inheritance manifest, relative to the config directory")
+	detectExtension := flag.Bool("detect-extension", false, "parse yaml, json and toml config files")
+	secretKeys := flag.String("secret", "", "comma separated keys or sections to redact, "+
+		"in addition to credential-like keys and URLs with credentials")
+	flag.Parse()
+
+	diffs, err := utils.DiffEnvironments(*configDir, *leftEnv, *rightEnv, nil, func(o *utils.ConfigParserOptions) {
+		o.EnvManifest = *manifest
+		o.DetectExtension = *detectExtension
+		if *secretKeys != "" {
+			o.SecretKeys = strings.Split(*secretKeys, ",")
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(2)
+	}
+	err = utils.WriteConfigDiff(os.Stdout, *leftEnv, *rightEnv, diffs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(2)
+	}
+	if len(diffs) != 0 {
+		os.Exit(1)
+	}
+}
@@ -1,19 +1,33 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 )
 
 const (
-	rootFile  = "main"
-	localMark = ".local"
+	rootFile   = "main"
+	localMark  = ".local"
+	includeKey = "include"
+
+	replaceMark = "!"
+	appendMark  = "+"
 )
 
 func ParseConfig(configDir string, out interface{}, options ...func(*ConfigParserOptions)) error {
@@ -25,6 +39,30 @@ type ConfigParserOptions struct {
 	Env         string
 	Transformer DataTransformer
 	Extension   string
+	// If set, files of every extension from Transformers are parsed by the matching transformer.
+	DetectExtension bool
+	Transformers    map[string]DataTransformer
+	// If set, Parse fails when the config contains keys that don't map to any field of out.
+	Strict bool
+	// Parent environments: {"staging-eu": "staging"} makes staging-eu files override staging ones.
+	EnvParents map[string]string
+	// Path to a file with parent environments in the same format, relative to the config dir.
+	EnvManifest string
+	// Flags registered by BindConfigFlags, set flags take priority over all other layers.
+	Flags *flag.FlagSet
+	// If set, the config dir is read from FS instead of the OS file system.
+	FS fs.FS
+	// Built-in config tree, e.g. embedded into the binary, layered under the config dir.
+	// If it's set, the config dir and its env dirs may be missing.
+	DefaultFS  fs.FS
+	DefaultDir string
+	// Keys under KeyValuePrefix are applied right after the env .local files.
+	KeyValueStore  KeyValueStore
+	KeyValuePrefix string
+	// Dotted keys, or whole sections, redacted like fields tagged as secret.
+	SecretKeys []string
+	// If set, variables like <EnvPrefix>_MONGO__HOST override the "mongo.host" key after all files are merged.
+	EnvPrefix string
 }
 
 type DataTransformer interface {
@@ -44,9 +82,52 @@ func (self YamlTransformer) Marshal(in interface{}) ([]byte, error) {
 	return b, errors.Wrap(err, "yaml marshal")
 }
 
+type JsonTransformer struct{}
+
+func (self JsonTransformer) Unmarshal(in []byte, out interface{}) error {
+	err := json.Unmarshal(in, out)
+	return errors.Wrap(err, "json unmarshal")
+}
+
+func (self JsonTransformer) Marshal(in interface{}) ([]byte, error) {
+	b, err := json.Marshal(in)
+	return b, errors.Wrap(err, "json marshal")
+}
+
+type TomlTransformer struct{}
+
+func (self TomlTransformer) Unmarshal(in []byte, out interface{}) error {
+	err := toml.Unmarshal(in, out)
+	return errors.Wrap(err, "toml unmarshal")
+}
+
+func (self TomlTransformer) Marshal(in interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := toml.NewEncoder(&buf).Encode(in)
+	return buf.Bytes(), errors.Wrap(err, "toml marshal")
+}
+
+func DefaultTransformers() map[string]DataTransformer {
+	return map[string]DataTransformer{
+		".yaml": YamlTransformer{},
+		".yml":  YamlTransformer{},
+		".json": JsonTransformer{},
+		".toml": TomlTransformer{},
+	}
+}
+
 type ConfigParser struct {
-	configDir string
-	envDir    string
+	// guards state of the last Parse call, which may run concurrently with Sources and Explain
+	mutex         sync.RWMutex
+	configDir     string
+	roots         []configRoot
+	envs          []string
+	includedFiles map[string]bool
+	sources       ConfigSources
+	data          map[string]interface{}
+	secrets       map[string]bool
+	// keys referenced by interpolated keys
+	refs map[string][]string
 
 	options ConfigParserOptions
 }
@@ -70,17 +151,37 @@ func NewConfigParser(configDir string, options ...func(*ConfigParserOptions)) *C
 	if parser.options.Transformer == nil {
 		parser.options.Transformer = YamlTransformer{}
 	}
-	parser.envDir = path.Join(configDir, parser.options.Env)
+	if parser.options.Transformers == nil {
+		parser.options.Transformers = DefaultTransformers()
+	}
+
+	if parser.options.DefaultFS != nil {
+		defaultDir := parser.options.DefaultDir
+		if defaultDir == "" {
+			defaultDir = "."
+		}
+		parser.roots = append(parser.roots, configRoot{fsys: parser.options.DefaultFS, dir: defaultDir, bundled: true})
+	}
+	parser.roots = append(parser.roots, configRoot{fsys: parser.options.FS, dir: configDir})
 
 	return parser
 }
 
 func (self *ConfigParser) Parse(out interface{}) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	err := self.parse(out)
 	return errors.Wrap(err, "can't parse config")
 }
 
 func (self *ConfigParser) parse(out interface{}) error {
+	self.sources = ConfigSources{}
+	envs, err := self.resolveEnvs()
+	if err != nil {
+		return err
+	}
+	self.envs = envs
+	self.includedFiles = map[string]bool{}
 	configData, err := self.processFile(rootFile)
 	if err != nil {
 		return err
@@ -96,32 +197,82 @@ func (self *ConfigParser) parse(out interface{}) error {
 		}
 		configData[fileName] = data
 	}
-	self.writeToOut(configData, out)
-	return nil
+	if self.options.KeyValueStore != nil {
+		err = applyKeyValueStore(self.options.KeyValueStore, self.options.KeyValuePrefix, configData, self.sources, out)
+		if err != nil {
+			return err
+		}
+	}
+	if self.options.EnvPrefix != "" {
+		err = applyEnvOverrides(self.options.EnvPrefix, os.Environ(), configData, self.sources, out)
+		if err != nil {
+			return err
+		}
+	}
+	if self.options.Flags != nil {
+		err = applyFlagOverrides(self.options.Flags, configData, self.sources, out)
+		if err != nil {
+			return err
+		}
+	}
+	err = applyConfigDefaults(reflect.TypeOf(out), configData, "", self.sources)
+	if err != nil {
+		return err
+	}
+	// secret refs are resolved after interpolation, so that secret values are never scanned for key references
+	refs, err := interpolateConfig(configData)
+	if err != nil {
+		return err
+	}
+	self.secrets = map[string]bool{}
+	err = resolveSecretRefs(configData, "", self.secrets)
+	if err != nil {
+		return err
+	}
+	configSecretPaths(reflect.TypeOf(out), "", self.secrets, map[reflect.Type]bool{})
+	markSecretKeys(configData, self.options.SecretKeys, self.secrets)
+	markReferencedSecrets(refs, self.secrets)
+	self.refs = refs
+	self.data = configData
+	if self.options.Strict {
+		err = self.checkUnknownKeys(configData, out)
+		if err != nil {
+			return err
+		}
+	}
+	err = self.writeToOut(configData, out)
+	if err != nil {
+		return err
+	}
+	return validateConfig(out, self.sources)
+}
+
+func (self *ConfigParser) checkUnknownKeys(configData map[string]interface{}, out interface{}) error {
+	if _, ok := out.(map[string]interface{}); ok {
+		return nil
+	}
+	var unknownKeys []string
+	unknownConfigKeys(reflect.TypeOf(out), configData, "", &unknownKeys)
+	if len(unknownKeys) == 0 {
+		return nil
+	}
+	sort.Strings(unknownKeys)
+	for i, key := range unknownKeys {
+		if source, ok := self.sources.find(key); ok {
+			unknownKeys[i] = fmt.Sprintf("%s (%s)", key, source)
+		}
+	}
+	return errors.Errorf("unknown config keys: %s", strings.Join(unknownKeys, ", "))
 }
 
 func (self *ConfigParser) getAllFiles() ([]string, error) {
 	uniqueFiles := map[string]bool{}
-	for _, dirPath := range []string{self.configDir, self.envDir} {
-		dirFiles, err := ioutil.ReadDir(dirPath)
-		if err != nil {
-			return nil, errors.Wrap(err, "get config dir files")
-		}
-		for _, info := range dirFiles {
-			if info.IsDir() {
-				continue
-			}
-			fileName := info.Name()
-			if !strings.HasSuffix(fileName, self.options.Extension) {
-				continue
+	for _, root := range self.roots {
+		for _, dirPath := range root.dirs(self.envs) {
+			err := self.collectDirFiles(root, dirPath, uniqueFiles)
+			if err != nil {
+				return nil, err
 			}
-			if strings.Contains(fileName, localMark) {
-				continue
-			}
-			if strings.Contains(fileName, rootFile) {
-				continue
-			}
-			uniqueFiles[strings.TrimSuffix(fileName, self.options.Extension)] = true
 		}
 	}
 	var resultFiles []string
@@ -131,52 +282,164 @@ func (self *ConfigParser) getAllFiles() ([]string, error) {
 	return resultFiles, nil
 }
 
-func (self *ConfigParser) processFile(fileName string) (map[string]interface{}, error) {
-	resultData := map[string]interface{}{}
-
-	generalFile := path.Join(self.configDir, fileName+self.options.Extension)
-	err := self.mergeFileData(generalFile, resultData)
+func (self *ConfigParser) collectDirFiles(root configRoot, dirPath string, uniqueFiles map[string]bool) error {
+	dirFiles, err := root.readDir(dirPath)
 	if err != nil {
-		return nil, err
+		// with built-in defaults the on-disk tree and its env dirs are optional
+		if (root.bundled || self.options.DefaultFS != nil) && os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "get config dir files")
+	}
+	for _, info := range dirFiles {
+		if info.IsDir() {
+			continue
+		}
+		fileName := info.Name()
+		extension := self.matchExtension(fileName)
+		if extension == "" {
+			continue
+		}
+		if strings.Contains(fileName, localMark) {
+			continue
+		}
+		if strings.Contains(fileName, rootFile) {
+			continue
+		}
+		if !root.bundled && self.isEnvManifest(path.Join(dirPath, fileName)) {
+			continue
+		}
+		uniqueFiles[strings.TrimSuffix(fileName, extension)] = true
+	}
+	return nil
+}
+
+func (self *ConfigParser) extensions() []string {
+	if !self.options.DetectExtension {
+		return []string{self.options.Extension}
 	}
+	var extensions []string
+	for extension := range self.options.Transformers {
+		extensions = append(extensions, extension)
+	}
+	sort.Strings(extensions)
+	return extensions
+}
 
-	generalLocalFile := path.Join(self.configDir, fileName+localMark+self.options.Extension)
-	err = self.mergeFileData(generalLocalFile, resultData)
-	if err != nil {
-		return nil, err
+func (self *ConfigParser) matchExtension(fileName string) string {
+	var result string
+	for _, extension := range self.extensions() {
+		if strings.HasSuffix(fileName, extension) && len(extension) > len(result) {
+			result = extension
+		}
 	}
+	return result
+}
 
-	envFile := path.Join(self.envDir, fileName+self.options.Extension)
-	err = self.mergeFileData(envFile, resultData)
-	if err != nil {
-		return nil, err
+func (self *ConfigParser) transformer(extension string) DataTransformer {
+	if self.options.DetectExtension {
+		return self.options.Transformers[extension]
 	}
+	return self.options.Transformer
+}
 
-	envLocalFile := path.Join(self.envDir, fileName+localMark+self.options.Extension)
-	err = self.mergeFileData(envLocalFile, resultData)
-	if err != nil {
-		return nil, err
+func (self *ConfigParser) processFile(fileName string) (map[string]interface{}, error) {
+	resultData := map[string]interface{}{}
+	keyPrefix := ""
+	if fileName != rootFile {
+		keyPrefix = fileName
+	}
+
+	for _, root := range self.roots {
+		err := self.mergeLayerFiles(root, root.dir, fileName, LayerGeneral, keyPrefix, resultData)
+		if err != nil {
+			return nil, err
+		}
+
+		err = self.mergeLayerFiles(root, root.dir, fileName+localMark, LayerGeneralLocal, keyPrefix, resultData)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, env := range self.envs {
+			envDir := path.Join(root.dir, env)
+			err = self.mergeLayerFiles(root, envDir, fileName, LayerEnv, keyPrefix, resultData)
+			if err != nil {
+				return nil, err
+			}
+
+			err = self.mergeLayerFiles(root, envDir, fileName+localMark, LayerEnvLocal, keyPrefix, resultData)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return resultData, nil
 }
 
-func (self *ConfigParser) mergeFileData(filePath string, resultData map[string]interface{}) error {
-	b, exists, err := readFile(filePath)
+func (self *ConfigParser) mergeLayerFiles(root configRoot, dirPath, baseName, layer, keyPrefix string,
+	resultData map[string]interface{}) error {
+
+	for _, extension := range self.extensions() {
+		filePath := path.Join(dirPath, baseName+extension)
+		err := self.mergeFileData(root, filePath, self.transformer(extension), root.layer(layer), keyPrefix, resultData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *ConfigParser) mergeFileData(root configRoot, filePath string, transformer DataTransformer,
+	layer, keyPrefix string, resultData map[string]interface{}) error {
+
+	b, exists, err := root.readFile(filePath)
 	if err != nil {
 		return errors.Wrapf(err, "file: %s", filePath)
 	}
 	if exists {
-		fileData := map[string]interface{}{}
-		err = self.options.Transformer.Unmarshal(b, fileData)
-		if err != nil {
-			return errors.Wrapf(err, "file: %s", filePath)
-		}
-		resultData = mergeData(resultData, fileData)
+		return self.mergeFileBytes(root, filePath, b, transformer, layer, keyPrefix, nil, resultData)
+	}
+	return nil
+}
+
+// mergeFileBytes merges the included files and then the file itself into resultData,
+// so merge marks of every file apply against the layers below it.
+func (self *ConfigParser) mergeFileBytes(root configRoot, filePath string, b []byte, transformer DataTransformer,
+	layer, keyPrefix string, includedFrom []string, resultData map[string]interface{}) error {
+
+	fileData := map[string]interface{}{}
+	err := transformer.Unmarshal(b, &fileData)
+	if err != nil {
+		return errors.Wrapf(err, "file: %s", filePath)
 	}
+	fileData = normalizeConfigMap(fileData)
+	err = self.mergeIncludes(root, filePath, fileData, layer, keyPrefix, includedFrom, resultData)
+	if err != nil {
+		return err
+	}
+	self.sources.record(keyPrefix, fileData, ConfigSource{Layer: layer, Location: root.location(filePath)})
+	mergeData(resultData, fileData)
 	return nil
 }
 
+func joinKeyPath(keyPath, key string) string {
+	if keyPath == "" {
+		return key
+	}
+	return keyPath + "." + key
+}
+
+// DumpConfig represents config in yaml with secret fields redacted.
+func DumpConfig(config interface{}) string {
+	b, err := yaml.Marshal(RedactSecrets(config))
+	if err != nil {
+		return fmt.Sprintf("cannot represent as yaml: %s", err)
+	}
+	return string(b)
+}
+
 func (self *ConfigParser) writeToOut(configData map[string]interface{}, out interface{}) error {
 	outMap, ok := out.(map[string]interface{})
 	if ok {
@@ -185,21 +448,90 @@ func (self *ConfigParser) writeToOut(configData map[string]interface{}, out inte
 		}
 		return nil
 	}
-	bytesRepresentation, err := self.options.Transformer.Marshal(configData)
-	if err != nil {
-		return err
-	}
-	return self.options.Transformer.Unmarshal(bytesRepresentation, out)
-
+	return decodeConfig(configData, out)
 }
 
+// mergeData deep merges nested maps from "from" into "to". A key with the replaceMark suffix ("mongo!")
+// replaces the whole subtree instead of merging it, a key with the appendMark suffix ("admins+")
+// appends its items to the existing list. Other lists are replaced.
 func mergeData(to, from map[string]interface{}) map[string]interface{} {
 	for k, v := range from {
-		to[k] = v
+		switch {
+		case strings.HasSuffix(k, replaceMark):
+			to[strings.TrimSuffix(k, replaceMark)] = cleanMergeValue(v)
+		case strings.HasSuffix(k, appendMark):
+			key := strings.TrimSuffix(k, appendMark)
+			existing, _ := to[key].([]interface{})
+			items, ok := v.([]interface{})
+			if !ok {
+				items = []interface{}{v}
+			}
+			result := make([]interface{}, 0, len(existing)+len(items))
+			result = append(result, existing...)
+			for _, item := range items {
+				result = append(result, cleanMergeValue(item))
+			}
+			to[key] = result
+		default:
+			fromMap, fromOk := v.(map[string]interface{})
+			toMap, toOk := to[k].(map[string]interface{})
+			if fromOk && toOk {
+				to[k] = mergeData(toMap, fromMap)
+			} else {
+				to[k] = cleanMergeValue(v)
+			}
+		}
 	}
 	return to
 }
 
+func cleanMergeValue(value interface{}) interface{} {
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	return mergeData(map[string]interface{}{}, valueMap)
+}
+
+func normalizeConfigMap(data map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		result[k] = normalizeConfigValue(v)
+	}
+	return result
+}
+
+func normalizeConfigValue(data interface{}) interface{} {
+	switch item := data.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(item))
+		for k, v := range item {
+			result[fmt.Sprintf("%v", k)] = normalizeConfigValue(v)
+		}
+		return result
+	case map[string]interface{}:
+		return normalizeConfigMap(item)
+	case []interface{}:
+		result := make([]interface{}, len(item))
+		for i, v := range item {
+			result[i] = normalizeConfigValue(v)
+		}
+		return result
+	case []map[string]interface{}:
+		// toml arrays of tables
+		result := make([]interface{}, len(item))
+		for i, v := range item {
+			result[i] = normalizeConfigMap(v)
+		}
+		return result
+	case time.Time:
+		// toml datetimes, kept as strings like yaml ones, time.Time fields decode them back
+		return item.Format(time.RFC3339Nano)
+	default:
+		return data
+	}
+}
+
 func readFile(filePath string) ([]byte, bool, error) {
 	b, err := ioutil.ReadFile(filePath)
 	if err != nil {
@@ -212,21 +544,31 @@ func readFile(filePath string) ([]byte, bool, error) {
 }
 
 type RootConfig struct {
-	ServiceName string `yaml:"service_name" json:"service_name"`
-	Port        int    `yaml:"port" json:"port"`
-	LogLevel    string `yaml:"log_level" json:"log_level"`
+	ServiceName string `yaml:"service_name" json:"service_name" validate:"required,nonempty"`
+	Port        int    `yaml:"port" json:"port" validate:"max=65535"`
+	LogLevel    string `yaml:"log_level" json:"log_level" validate:"oneof=debug info warning error" default:"info"`
 }
 
 type DatabaseSettings struct {
-	Host            string `yaml:"host" json:"host"`
-	Port            int    `yaml:"port" json:"port"`
-	User            string `yaml:"user" json:"user"`
-	Database        string `yaml:"database" json:"database"`
-	Password        string `yaml:"password" json:"password"`
-	Timeout         int    `yaml:"timeout" json:"timeout"`
-	PoolSize        int    `yaml:"pool_size" json:"pool_size"`
-	RetriesNum      int    `yaml:"retries_num" json:"retries_num"`
-	RetriesInterval int    `yaml:"retries_interval" json:"retries_interval"`
+	Host     string   `yaml:"host" json:"host"`
+	Port     int      `yaml:"port" json:"port" validate:"min=1,max=65535"`
+	Hosts    []string `yaml:"hosts" json:"hosts"`
+	User     string   `yaml:"user" json:"user"`
+	Database string   `yaml:"database" json:"database"`
+	Password string   `yaml:"password" json:"password" secret:"true"`
+	// Seconds, or a duration like "5s".
+	Timeout    int `yaml:"timeout" json:"timeout" validate:"min=0" default:"5" unit:"s"`
+	PoolSize   int `yaml:"pool_size" json:"pool_size" validate:"min=0"`
+	RetriesNum int `yaml:"retries_num" json:"retries_num" validate:"min=0"`
+	// Milliseconds, or a duration like "500ms".
+	RetriesInterval int `yaml:"retries_interval" json:"retries_interval" validate:"min=0" unit:"ms"`
+	// Double the retries interval after every attempt, up to RetriesMaxInterval if it's set.
+	RetriesBackoff bool `yaml:"retries_backoff" json:"retries_backoff"`
+	// Milliseconds, or a duration like "30s".
+	RetriesMaxInterval int    `yaml:"retries_max_interval" json:"retries_max_interval" validate:"min=0" unit:"ms"`
+	TLS                bool   `yaml:"tls" json:"tls"`
+	TLSCAFile          string `yaml:"tls_ca_file" json:"tls_ca_file"`
+	TLSInsecure        bool   `yaml:"tls_insecure" json:"tls_insecure"`
 }
 
 type S3Setting struct {
@@ -236,27 +578,39 @@ type S3Setting struct {
 
 type AwsCreds struct {
 	AccountID     string `yaml:"account_id" json:"account_id"`
-	AccountSecret string `yaml:"account_secret" json:"account_secret"`
+	AccountSecret string `yaml:"account_secret" json:"account_secret" secret:"true"`
 }
 
 type MongoDBSettings struct {
 	DatabaseSettings `yaml:",inline" json:",inline"`
 	Collection       string `yaml:"collection" json:"collection"`
+	// mongodb:// connection string, explicitly set fields take precedence over its options.
+	URI        string `yaml:"uri" json:"uri" secret:"true"`
+	AuthSource string `yaml:"auth_source" json:"auth_source"`
+	ReplicaSet string `yaml:"replica_set" json:"replica_set"`
+	// Write concern w: "majority", a number of nodes or a tag set, "0" disables acknowledgement.
+	// If neither these fields nor the URI set them, writes are acknowledged by majority with journaling.
+	WriteConcern string `yaml:"write_concern" json:"write_concern"`
+	Journal      *bool  `yaml:"journal" json:"journal"`
+	// Milliseconds, or a duration like "10s", Timeout is used if it's not set.
+	WriteTimeout int `yaml:"write_timeout" json:"write_timeout" validate:"min=0" unit:"ms"`
+	// Eventual if neither this field nor the URI sets it.
+	ReadPreference string `yaml:"read_preference" json:"read_preference" validate:"oneof=eventual monotonic strong primary primaryPreferred secondary secondaryPreferred nearest"`
 }
 
 type SentrySettings struct {
-	DSN string `yaml:"dsn" json:"dsn"`
+	DSN string `yaml:"dsn" json:"dsn" validate:"url" secret:"true"`
 }
 
 type TelegramSettings struct {
-	APIToken    string `yaml:"api_token" json:"api_token"`
+	APIToken    string `yaml:"api_token" json:"api_token" validate:"required,nonempty" secret:"true"`
 	BotName     string `yaml:"bot_name" json:"bot_name"`
-	HttpTimeout int    `yaml:"http_timeout" json:"http_timeout"`
-	Retries     int    `yaml:"retries" json:"retries"`
+	HttpTimeout int    `yaml:"http_timeout" json:"http_timeout" validate:"min=0"`
+	Retries     int    `yaml:"retries" json:"retries" validate:"min=0"`
 }
 
 type GoogleAPI struct {
-	APIKey      string `yaml:"api_key" json:"api_key"`
+	APIKey      string `yaml:"api_key" json:"api_key" secret:"true"`
 	HttpTimeout int    `yaml:"http_timeout" json:"http_timeout"`
 }
 
@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const unitTag = "unit"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decodeConfig writes merged config data into out, which must be a pointer.
+// Durations accept strings like "5s", types implementing encoding.TextUnmarshaler accept strings.
+// Integer fields with a unit tag, e.g. unit:"s", accept duration strings too and keep bare numbers in the unit.
+func decodeConfig(data map[string]interface{}, out interface{}) error {
+	value := reflect.ValueOf(out)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return errors.Errorf("config out must be a non-nil pointer, got %T", out)
+	}
+	return decodeConfigValue(data, value.Elem(), "")
+}
+
+func decodeConfigValue(data interface{}, target reflect.Value, keyPath string) error {
+	if data == nil {
+		return nil
+	}
+	if target.Kind() == reflect.Ptr {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		return decodeConfigValue(data, target.Elem(), keyPath)
+	}
+	if target.CanAddr() {
+		if unmarshaler, ok := target.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			text, ok := data.(string)
+			if !ok {
+				return decodeError(keyPath, data, target.Type())
+			}
+			err := unmarshaler.UnmarshalText([]byte(text))
+			return errors.Wrapf(err, "key %s", keyPath)
+		}
+	}
+	if target.Type() == durationType {
+		return decodeDuration(data, target, keyPath)
+	}
+
+	switch target.Kind() {
+	case reflect.Interface:
+		target.Set(reflect.ValueOf(data))
+	case reflect.Struct:
+		dataMap, ok := data.(map[string]interface{})
+		if !ok {
+			return decodeError(keyPath, data, target.Type())
+		}
+		return decodeStruct(dataMap, target, keyPath, map[string]bool{})
+	case reflect.Map:
+		dataMap, ok := data.(map[string]interface{})
+		if !ok {
+			return decodeError(keyPath, data, target.Type())
+		}
+		return decodeMap(dataMap, target, keyPath, nil)
+	case reflect.Slice:
+		items, ok := data.([]interface{})
+		if !ok {
+			return decodeError(keyPath, data, target.Type())
+		}
+		result := reflect.MakeSlice(target.Type(), len(items), len(items))
+		for i, item := range items {
+			err := decodeConfigValue(item, result.Index(i), joinKeyPath(keyPath, strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+		}
+		target.Set(result)
+	case reflect.Array:
+		items, ok := data.([]interface{})
+		if !ok || len(items) != target.Len() {
+			return decodeError(keyPath, data, target.Type())
+		}
+		for i, item := range items {
+			err := decodeConfigValue(item, target.Index(i), joinKeyPath(keyPath, strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		switch item := data.(type) {
+		case string:
+			target.SetString(item)
+		case bool, int, int64, uint, uint64, float64:
+			target.SetString(fmt.Sprintf("%v", item))
+		default:
+			return decodeError(keyPath, data, target.Type())
+		}
+	case reflect.Bool:
+		switch item := data.(type) {
+		case bool:
+			target.SetBool(item)
+		case string:
+			result, err := strconv.ParseBool(item)
+			if err != nil {
+				return decodeError(keyPath, data, target.Type())
+			}
+			target.SetBool(result)
+		default:
+			return decodeError(keyPath, data, target.Type())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := integerValue(data)
+		if !ok || target.OverflowInt(number) {
+			return decodeError(keyPath, data, target.Type())
+		}
+		target.SetInt(number)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := integerValue(data)
+		if !ok || number < 0 || target.OverflowUint(uint64(number)) {
+			return decodeError(keyPath, data, target.Type())
+		}
+		target.SetUint(uint64(number))
+	case reflect.Float32, reflect.Float64:
+		number, ok := floatValue(data)
+		if !ok || target.OverflowFloat(number) {
+			return decodeError(keyPath, data, target.Type())
+		}
+		target.SetFloat(number)
+	default:
+		return decodeError(keyPath, data, target.Type())
+	}
+	return nil
+}
+
+// decodeStruct marks keys decoded into fields as consumed, inline maps receive the rest of the keys.
+func decodeStruct(data map[string]interface{}, target reflect.Value, keyPath string, consumed map[string]bool) error {
+	targetType := target.Type()
+	var inlineMaps []reflect.Value
+	for i := 0; i < targetType.NumField(); i++ {
+		field := targetType.Field(i)
+		name, inline, skip := configFieldName(field)
+		if skip {
+			continue
+		}
+		fieldValue := target.Field(i)
+		if inline {
+			if fieldValue.Kind() == reflect.Ptr {
+				if fieldValue.IsNil() {
+					fieldValue.Set(reflect.New(field.Type.Elem()))
+				}
+				fieldValue = fieldValue.Elem()
+			}
+			switch fieldValue.Kind() {
+			case reflect.Struct:
+				err := decodeStruct(data, fieldValue, keyPath, consumed)
+				if err != nil {
+					return err
+				}
+			case reflect.Map:
+				inlineMaps = append(inlineMaps, fieldValue)
+			default:
+				return errors.Errorf("key %s: inline field %s must be a struct or a map", keyPath, field.Name)
+			}
+			continue
+		}
+		consumed[name] = true
+		value, ok := data[name]
+		if !ok {
+			continue
+		}
+		if unit := field.Tag.Get(unitTag); unit != "" {
+			var err error
+			value, err = durationInUnit(value, unit, joinKeyPath(keyPath, name))
+			if err != nil {
+				return err
+			}
+		}
+		err := decodeConfigValue(value, fieldValue, joinKeyPath(keyPath, name))
+		if err != nil {
+			return err
+		}
+	}
+	for _, inlineMap := range inlineMaps {
+		err := decodeMap(data, inlineMap, keyPath, consumed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeMap(data map[string]interface{}, target reflect.Value, keyPath string, skipKeys map[string]bool) error {
+	targetType := target.Type()
+	if targetType.Key().Kind() != reflect.String {
+		return errors.Errorf("key %s: unsupported map key type %s", keyPath, targetType.Key())
+	}
+	if target.IsNil() {
+		target.Set(reflect.MakeMapWithSize(targetType, len(data)))
+	}
+	for k, v := range data {
+		if skipKeys[k] {
+			continue
+		}
+		elem := reflect.New(targetType.Elem()).Elem()
+		err := decodeConfigValue(v, elem, joinKeyPath(keyPath, k))
+		if err != nil {
+			return err
+		}
+		target.SetMapIndex(reflect.ValueOf(k).Convert(targetType.Key()), elem)
+	}
+	return nil
+}
+
+func decodeDuration(data interface{}, target reflect.Value, keyPath string) error {
+	if text, ok := data.(string); ok {
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return errors.Wrapf(err, "key %s", keyPath)
+		}
+		target.SetInt(int64(duration))
+		return nil
+	}
+	number, ok := integerValue(data)
+	if !ok {
+		return decodeError(keyPath, data, target.Type())
+	}
+	target.SetInt(number)
+	return nil
+}
+
+// durationInUnit converts a duration string into a whole number of units, other values are returned as is.
+func durationInUnit(data interface{}, unit, keyPath string) (interface{}, error) {
+	text, ok := data.(string)
+	if !ok {
+		return data, nil
+	}
+	if _, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return data, nil
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key %s", keyPath)
+	}
+	unitDuration, err := time.ParseDuration("1" + unit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key %s: unit", keyPath)
+	}
+	if duration%unitDuration != 0 {
+		return nil, errors.Errorf("key %s: %s is not a whole number of %s", keyPath, text, unit)
+	}
+	return int64(duration / unitDuration), nil
+}
+
+func integerValue(data interface{}) (int64, bool) {
+	switch item := data.(type) {
+	case int:
+		return int64(item), true
+	case int64:
+		return item, true
+	case uint:
+		return int64(item), item <= math.MaxInt64
+	case uint64:
+		return int64(item), item <= math.MaxInt64
+	case float64:
+		return int64(item), item == math.Trunc(item) && math.Abs(item) < math.MaxInt64
+	case string:
+		number, err := strconv.ParseInt(item, 10, 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func floatValue(data interface{}) (float64, bool) {
+	switch item := data.(type) {
+	case float64:
+		return item, true
+	case int:
+		return float64(item), true
+	case int64:
+		return float64(item), true
+	case uint:
+		return float64(item), true
+	case uint64:
+		return float64(item), true
+	case string:
+		number, err := strconv.ParseFloat(item, 64)
+		return number, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func decodeError(keyPath string, data interface{}, targetType reflect.Type) error {
+	if keyPath == "" {
+		keyPath = "<root>"
+	}
+	return errors.Errorf("key %s: cannot decode %#v into %s", keyPath, data, targetType)
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+const LayerDefault = "default"
+
+// applyConfigDefaults sets values from "default" struct tags for keys that no layer has supplied.
+// Sections behind pointer fields get defaults only if some layer mentions them.
+func applyConfigDefaults(t reflect.Type, data map[string]interface{}, keyPath string, sources ConfigSources) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline, skip := configFieldName(field)
+		if skip {
+			continue
+		}
+		if inline {
+			err := applyConfigDefaults(field.Type, data, keyPath, sources)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		fieldPath := joinKeyPath(keyPath, name)
+		fieldType, _ := configFieldType(field.Type, nil)
+		if defaultValue, ok := field.Tag.Lookup(defaultTag); ok {
+			if _, exists := data[name]; exists {
+				continue
+			}
+			value, err := coerceConfigString(defaultValue, fieldType)
+			if err != nil {
+				return errors.Wrapf(err, "default of %s", fieldPath)
+			}
+			data[name] = value
+			sources.set(fieldPath, ConfigSource{Layer: LayerDefault, Location: "struct tag"})
+			continue
+		}
+		if isConfigLeafType(fieldType) {
+			continue
+		}
+		child, exists := data[name].(map[string]interface{})
+		if !exists {
+			if field.Type.Kind() == reflect.Ptr {
+				continue
+			}
+			child = map[string]interface{}{}
+		}
+		err := applyConfigDefaults(field.Type, child, fieldPath, sources)
+		if err != nil {
+			return err
+		}
+		if len(child) != 0 {
+			data[name] = child
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const envKeySeparator = "__"
+
+func applyEnvOverrides(prefix string, environ []string, configData map[string]interface{},
+	sources ConfigSources, out interface{}) error {
+	prefix = strings.TrimSuffix(prefix, "_") + "_"
+	outType := reflect.TypeOf(out)
+	for _, item := range environ {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) {
+			continue
+		}
+		keyPath := envKeyPath(strings.TrimPrefix(parts[0], prefix))
+		if keyPath == nil {
+			continue
+		}
+		var value interface{} = parts[1]
+		if fieldType, ok := configFieldType(outType, keyPath); ok {
+			var err error
+			value, err = coerceConfigString(parts[1], fieldType)
+			if err != nil {
+				return errors.Wrapf(err, "env variable %s", parts[0])
+			}
+		}
+		setConfigValue(configData, keyPath, value)
+		sources.set(strings.Join(keyPath, "."), ConfigSource{Layer: LayerOverride, Location: "env " + parts[0]})
+	}
+	return nil
+}
+
+func envKeyPath(name string) []string {
+	keyPath := strings.Split(strings.ToLower(name), envKeySeparator)
+	for _, key := range keyPath {
+		if key == "" {
+			return nil
+		}
+	}
+	return keyPath
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// resolveEnvs returns the environment and its ancestors, the most distant ancestor goes first.
+func (self *ConfigParser) resolveEnvs() ([]string, error) {
+	parents, err := self.envParents()
+	if err != nil {
+		return nil, err
+	}
+	var envs []string
+	visited := map[string]bool{}
+	for env := self.options.Env; env != ""; env = parents[env] {
+		if visited[env] {
+			return nil, errors.Errorf("environments inheritance cycle: %v", append(envs, env))
+		}
+		visited[env] = true
+		envs = append(envs, env)
+	}
+	for i, j := 0, len(envs)-1; i < j; i, j = i+1, j-1 {
+		envs[i], envs[j] = envs[j], envs[i]
+	}
+	return envs, nil
+}
+
+func (self configRoot) dirs(envs []string) []string {
+	dirs := []string{self.dir}
+	for _, env := range envs {
+		dirs = append(dirs, path.Join(self.dir, env))
+	}
+	return dirs
+}
+
+func (self *ConfigParser) mainRoot() configRoot {
+	return self.roots[len(self.roots)-1]
+}
+
+func (self *ConfigParser) envParents() (map[string]string, error) {
+	parents := map[string]string{}
+	if self.options.EnvManifest != "" {
+		manifestPath := self.envManifestPath()
+		b, exists, err := self.mainRoot().readFile(manifestPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "environments manifest: %s", manifestPath)
+		}
+		if !exists {
+			return nil, errors.Errorf("environments manifest doesn't exist: %s", manifestPath)
+		}
+		err = self.options.Transformer.Unmarshal(b, &parents)
+		if err != nil {
+			return nil, errors.Wrapf(err, "environments manifest: %s", manifestPath)
+		}
+	}
+	for env, parent := range self.options.EnvParents {
+		parents[env] = parent
+	}
+	return parents, nil
+}
+
+func (self *ConfigParser) envManifestPath() string {
+	if path.IsAbs(self.options.EnvManifest) {
+		return self.options.EnvManifest
+	}
+	return path.Join(self.configDir, self.options.EnvManifest)
+}
+
+func (self *ConfigParser) isEnvManifest(filePath string) bool {
+	return self.options.EnvManifest != "" && path.Clean(filePath) == self.envManifestPath()
+}
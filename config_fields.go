@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func configFieldName(field reflect.StructField) (name string, inline bool, skip bool) {
+	if field.PkgPath != "" && !field.Anonymous {
+		return "", false, true
+	}
+	tagParts := strings.Split(field.Tag.Get("yaml"), ",")
+	name = tagParts[0]
+	if name == "-" {
+		return "", false, true
+	}
+	for _, flag := range tagParts[1:] {
+		if flag == "inline" {
+			inline = true
+		}
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, inline, false
+}
+
+func configFieldType(t reflect.Type, keyPath []string) (reflect.Type, bool) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return nil, false
+	}
+	if len(keyPath) == 0 {
+		return t, true
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return configFieldType(t.Elem(), keyPath[1:])
+	case reflect.Interface:
+		return t, true
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, inline, skip := configFieldName(field)
+			if skip {
+				continue
+			}
+			if inline {
+				if fieldType, ok := configFieldType(field.Type, keyPath); ok {
+					return fieldType, true
+				}
+				continue
+			}
+			if name == keyPath[0] {
+				return configFieldType(field.Type, keyPath[1:])
+			}
+		}
+	}
+	return nil, false
+}
+
+// unknownConfigKeys collects paths of keys in data that don't map to any field of t.
+func unknownConfigKeys(t reflect.Type, data interface{}, keyPath string, result *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch item := data.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct && t.Kind() != reflect.Map {
+			return
+		}
+		for k, v := range item {
+			childPath := joinKeyPath(keyPath, k)
+			fieldType, ok := configFieldType(t, []string{k})
+			if !ok {
+				*result = append(*result, childPath)
+				continue
+			}
+			unknownConfigKeys(fieldType, v, childPath, result)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return
+		}
+		for i, v := range item {
+			unknownConfigKeys(t.Elem(), v, joinKeyPath(keyPath, strconv.Itoa(i)), result)
+		}
+	}
+}
+
+func coerceConfigString(value string, t reflect.Type) (interface{}, error) {
+	if t == durationType || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return value, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		result, err := strconv.ParseBool(value)
+		return result, errors.Wrap(err, "parse bool")
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		result, err := strconv.ParseInt(value, 10, t.Bits())
+		if err != nil {
+			// a duration for a field with a unit tag, converted on decoding
+			if _, durationErr := time.ParseDuration(value); durationErr == nil {
+				return value, nil
+			}
+		}
+		return int(result), errors.Wrap(err, "parse int")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		result, err := strconv.ParseUint(value, 10, t.Bits())
+		return uint(result), errors.Wrap(err, "parse uint")
+	case reflect.Float32, reflect.Float64:
+		result, err := strconv.ParseFloat(value, t.Bits())
+		return result, errors.Wrap(err, "parse float")
+	case reflect.Slice:
+		result := []interface{}{}
+		if value == "" {
+			return result, nil
+		}
+		for _, item := range strings.Split(value, ",") {
+			element, err := coerceConfigString(strings.TrimSpace(item), t.Elem())
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, element)
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+func setConfigValue(data map[string]interface{}, keyPath []string, value interface{}) {
+	for _, key := range keyPath[:len(keyPath)-1] {
+		child, ok := data[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			data[key] = child
+		}
+		data = child
+	}
+	data[keyPath[len(keyPath)-1]] = value
+}
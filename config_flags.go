@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"encoding"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+type configFlag struct {
+	value  string
+	isBool bool
+}
+
+func (self *configFlag) String() string {
+	return self.value
+}
+
+func (self *configFlag) Set(value string) error {
+	self.value = value
+	return nil
+}
+
+func (self *configFlag) IsBoolFlag() bool {
+	return self.isBool
+}
+
+// BindConfigFlags registers a flag for every leaf field of config, named by its dotted path: --port, --mongo.host.
+// Pass the flag set to ConfigParserOptions.Flags after parsing the command line, values of the set flags
+// are applied over all config files.
+func BindConfigFlags(flagSet *flag.FlagSet, config interface{}) {
+	bindConfigFlags(flagSet, reflect.TypeOf(config), "", map[reflect.Type]bool{})
+}
+
+func bindConfigFlags(flagSet *flag.FlagSet, t reflect.Type, keyPath string, visiting map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline, skip := configFieldName(field)
+		if skip {
+			continue
+		}
+		fieldPath := keyPath
+		if !inline {
+			fieldPath = joinKeyPath(keyPath, name)
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if isConfigLeafType(fieldType) {
+			if flagSet.Lookup(fieldPath) == nil {
+				usage := fmt.Sprintf("config %s (%s)", fieldPath, fieldType)
+				flagSet.Var(&configFlag{isBool: fieldType.Kind() == reflect.Bool}, fieldPath, usage)
+			}
+			continue
+		}
+		bindConfigFlags(flagSet, fieldType, fieldPath, visiting)
+	}
+}
+
+func isConfigLeafType(t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Interface, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return false
+	default:
+		return true
+	}
+}
+
+func applyFlagOverrides(flagSet *flag.FlagSet, configData map[string]interface{}, sources ConfigSources,
+	out interface{}) error {
+
+	var applyErr error
+	outType := reflect.TypeOf(out)
+	flagSet.Visit(func(f *flag.Flag) {
+		configValue, ok := f.Value.(*configFlag)
+		if !ok || applyErr != nil {
+			return
+		}
+		keyPath := strings.Split(f.Name, ".")
+		var value interface{} = configValue.value
+		if fieldType, ok := configFieldType(outType, keyPath); ok {
+			var err error
+			value, err = coerceConfigString(configValue.value, fieldType)
+			if err != nil {
+				applyErr = errors.Wrapf(err, "flag --%s", f.Name)
+				return
+			}
+		}
+		setConfigValue(configData, keyPath, value)
+		sources.set(f.Name, ConfigSource{Layer: LayerOverride, Location: "flag --" + f.Name})
+	})
+	return applyErr
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const bundledLayerPrefix = "bundled."
+
+// configRoot is a config directory read either from the OS or from an fs.FS.
+// A bundled root holds built-in defaults, its layers go under the layers of the main config directory.
+type configRoot struct {
+	fsys    fs.FS
+	dir     string
+	bundled bool
+}
+
+func (self configRoot) layer(name string) string {
+	if self.bundled {
+		return bundledLayerPrefix + name
+	}
+	return name
+}
+
+func (self configRoot) location(filePath string) string {
+	if self.fsys == nil {
+		return filePath
+	}
+	return "fs:" + filePath
+}
+
+func (self configRoot) readFile(filePath string) ([]byte, bool, error) {
+	if self.fsys == nil {
+		return readFile(filePath)
+	}
+	b, err := fs.ReadFile(self.fsys, fsPath(filePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, errors.Wrap(err, "read config file")
+	}
+	return b, true, nil
+}
+
+func (self configRoot) readDir(dirPath string) ([]os.FileInfo, error) {
+	if self.fsys == nil {
+		return ioutil.ReadDir(dirPath)
+	}
+	entries, err := fs.ReadDir(self.fsys, fsPath(dirPath))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// fsPath converts a path to the unrooted form fs.FS requires.
+func fsPath(filePath string) string {
+	result := strings.TrimPrefix(path.Clean(filePath), "/")
+	if result == "" {
+		return "."
+	}
+	return result
+}
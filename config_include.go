@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// mergeIncludes removes the include directive from fileData and merges the included files into resultData.
+// Include paths are relative to the including file, the file's own keys override included ones.
+func (self *ConfigParser) mergeIncludes(root configRoot, filePath string, fileData map[string]interface{}, layer, keyPrefix string,
+	includedFrom []string, resultData map[string]interface{}) error {
+
+	directive, ok := fileData[includeKey]
+	if !ok {
+		return nil
+	}
+	delete(fileData, includeKey)
+	includePaths, err := parseIncludeDirective(directive)
+	if err != nil {
+		return errors.Wrapf(err, "file: %s", filePath)
+	}
+	includedFrom = append(includedFrom, path.Clean(filePath))
+	for _, includePath := range includePaths {
+		if !path.IsAbs(includePath) {
+			includePath = path.Join(path.Dir(filePath), includePath)
+		}
+		includePath = path.Clean(includePath)
+		for _, previous := range includedFrom {
+			if previous == includePath {
+				return errors.Errorf("include cycle: %s -> %s", strings.Join(includedFrom, " -> "), includePath)
+			}
+		}
+		transformer := self.transformer(self.matchExtension(includePath))
+		if transformer == nil {
+			return errors.Errorf("file: %s: unsupported include extension: %s", filePath, includePath)
+		}
+		b, exists, err := root.readFile(includePath)
+		if err != nil {
+			return errors.Wrapf(err, "file: %s: include", filePath)
+		}
+		if !exists {
+			return errors.Errorf("file: %s: included file doesn't exist: %s", filePath, includePath)
+		}
+		if root.fsys == nil {
+			self.includedFiles[includePath] = true
+		}
+		err = self.mergeFileBytes(root, includePath, b, transformer, layer, keyPrefix, includedFrom, resultData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseIncludeDirective(directive interface{}) ([]string, error) {
+	switch item := directive.(type) {
+	case string:
+		return []string{item}, nil
+	case []interface{}:
+		includePaths := make([]string, len(item))
+		for i, element := range item {
+			includePath, ok := element.(string)
+			if !ok {
+				return nil, errors.Errorf("include directive must contain paths, got %v", element)
+			}
+			includePaths[i] = includePath
+		}
+		return includePaths, nil
+	default:
+		return nil, errors.Errorf("include directive must be a path or a list of paths, got %v", directive)
+	}
+}
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ${key.path} references another config key, $${...} is kept as a literal ${...}.
+var keyRefRegexp = regexp.MustCompile(`\$?\$\{([^}:]+)\}`)
+
+type interpolator struct {
+	data      map[string]interface{}
+	resolving map[string]bool
+	chain     []string
+	refs      map[string][]string
+	// resolved values by key path, data holds them too, so they must never be resolved again
+	resolved map[string]interface{}
+}
+
+// interpolateConfig returns keys referenced by every interpolated key.
+func interpolateConfig(data map[string]interface{}) (map[string][]string, error) {
+	i := &interpolator{
+		data: data, resolving: map[string]bool{}, refs: map[string][]string{}, resolved: map[string]interface{}{},
+	}
+	return i.refs, i.resolveMap(data, "")
+}
+
+func (self *interpolator) resolveMap(data map[string]interface{}, keyPath string) error {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value, err := self.resolveKey(joinKeyPath(keyPath, k), data[k])
+		if err != nil {
+			return err
+		}
+		data[k] = value
+	}
+	return nil
+}
+
+func (self *interpolator) resolveKey(keyPath string, value interface{}) (interface{}, error) {
+	if resolved, ok := self.resolved[keyPath]; ok {
+		return resolved, nil
+	}
+	value, err := self.resolveValue(keyPath, value)
+	if err != nil {
+		return nil, err
+	}
+	self.resolved[keyPath] = value
+	return value, nil
+}
+
+func (self *interpolator) resolveValue(keyPath string, value interface{}) (interface{}, error) {
+	if self.resolving[keyPath] {
+		return nil, errors.Errorf("reference cycle: %s -> %s", strings.Join(self.chain, " -> "), keyPath)
+	}
+	self.resolving[keyPath] = true
+	self.chain = append(self.chain, keyPath)
+	defer func() {
+		delete(self.resolving, keyPath)
+		self.chain = self.chain[:len(self.chain)-1]
+	}()
+
+	switch item := value.(type) {
+	case map[string]interface{}:
+		return item, self.resolveMap(item, keyPath)
+	case []interface{}:
+		for i, element := range item {
+			resolved, err := self.resolveKey(joinKeyPath(keyPath, strconv.Itoa(i)), element)
+			if err != nil {
+				return nil, err
+			}
+			item[i] = resolved
+		}
+		return item, nil
+	case string:
+		return self.resolveString(keyPath, item)
+	default:
+		return value, nil
+	}
+}
+
+func (self *interpolator) resolveString(keyPath, value string) (interface{}, error) {
+	matches := keyRefRegexp.FindAllStringSubmatchIndex(value, -1)
+	if len(matches) == 0 {
+		return value, nil
+	}
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(value) && value[1] == '{' {
+		return self.resolveRef(keyPath, value[matches[0][2]:matches[0][3]])
+	}
+	var result strings.Builder
+	last := 0
+	for _, match := range matches {
+		result.WriteString(value[last:match[0]])
+		last = match[1]
+		ref := value[match[0]:match[1]]
+		if strings.HasPrefix(ref, "$$") {
+			result.WriteString(ref[1:])
+			continue
+		}
+		resolved, err := self.resolveRef(keyPath, value[match[2]:match[3]])
+		if err != nil {
+			return nil, err
+		}
+		switch resolved.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, errors.Errorf("key %s: reference ${%s} to a section can't be embedded in a string",
+				keyPath, value[match[2]:match[3]])
+		}
+		result.WriteString(fmt.Sprintf("%v", resolved))
+	}
+	result.WriteString(value[last:])
+	return result.String(), nil
+}
+
+func (self *interpolator) resolveRef(keyPath, ref string) (interface{}, error) {
+	ref = strings.TrimSpace(ref)
+	self.refs[keyPath] = append(self.refs[keyPath], ref)
+	value, ok := lookupConfigValue(self.data, strings.Split(ref, "."))
+	if !ok {
+		return nil, errors.Errorf("key %s: reference ${%s} to undefined key", keyPath, ref)
+	}
+	return self.resolveKey(ref, value)
+}
+
+// markReferencedSecrets marks keys that embed or copy secret values through references.
+func markReferencedSecrets(refs map[string][]string, secrets map[string]bool) {
+	for changed := true; changed; {
+		changed = false
+		for keyPath, keyRefs := range refs {
+			for _, ref := range keyRefs {
+				for secret := range secrets {
+					var target string
+					switch {
+					case secret == ref || strings.HasPrefix(ref, secret+"."):
+						target = keyPath
+					case strings.HasPrefix(secret, ref+"."):
+						target = keyPath + strings.TrimPrefix(secret, ref)
+					default:
+						continue
+					}
+					if !secrets[target] {
+						secrets[target] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+}
+
+func lookupConfigValue(data interface{}, keyPath []string) (interface{}, bool) {
+	for _, key := range keyPath {
+		switch item := data.(type) {
+		case map[string]interface{}:
+			value, ok := item[key]
+			if !ok {
+				return nil, false
+			}
+			data = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(item) {
+				return nil, false
+			}
+			data = item[index]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
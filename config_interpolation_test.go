@@ -0,0 +1,18 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestInterpolateConfigUnescapesOnce(t *testing.T) {
+	for _, escapedKey := range []string{"a", "z"} {
+		data := map[string]interface{}{escapedKey: "$${foo}", "b": "${" + escapedKey + "}", "foo": "bar"}
+		_, err := interpolateConfig(data)
+		if err != nil {
+			t.Fatalf("interpolate: %+v", err)
+		}
+		if data["b"] != "${foo}" || data[escapedKey] != "${foo}" {
+			t.Errorf("escaped key %s: got %v", escapedKey, data)
+		}
+	}
+}
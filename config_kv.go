@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const LayerRemote = "remote"
+
+// KeyValueStore is a remote config layer, keys are slash separated paths: "sentry/dsn" maps to "sentry.dsn".
+type KeyValueStore interface {
+	Name() string
+	List(prefix string) (map[string]string, error)
+}
+
+type MemoryStore map[string]string
+
+func (self MemoryStore) Name() string {
+	return "memory"
+}
+
+func (self MemoryStore) List(prefix string) (map[string]string, error) {
+	result := map[string]string{}
+	for k, v := range self {
+		if strings.HasPrefix(k, prefix) {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+// ConsulStore reads keys with Consul KV HTTP API.
+type ConsulStore struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+func NewConsulStore(address, token string, httpTimeout int) *ConsulStore {
+	return &ConsulStore{
+		address: strings.TrimSuffix(address, "/"), token: token,
+		client: &http.Client{Timeout: time.Duration(httpTimeout) * time.Second},
+	}
+}
+
+func (self *ConsulStore) Name() string {
+	return "consul " + self.address
+}
+
+func (self *ConsulStore) List(prefix string) (map[string]string, error) {
+	requestURL := fmt.Sprintf("%s/v1/kv/%s?recurse=true", self.address, (&url.URL{Path: prefix}).EscapedPath())
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "consul request")
+	}
+	if self.token != "" {
+		req.Header.Set("X-Consul-Token", self.token)
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "consul request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return map[string]string{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("consul response status: %s", resp.Status)
+	}
+	var pairs []struct {
+		Key   string
+		Value *string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&pairs)
+	if err != nil {
+		return nil, errors.Wrap(err, "consul response decode")
+	}
+	result := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		if pair.Value == nil {
+			result[pair.Key] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(*pair.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "consul value of %s", pair.Key)
+		}
+		result[pair.Key] = string(value)
+	}
+	return result, nil
+}
+
+func applyKeyValueStore(store KeyValueStore, prefix string, configData map[string]interface{},
+	sources ConfigSources, out interface{}) error {
+
+	pairs, err := store.List(prefix)
+	if err != nil {
+		return errors.Wrapf(err, "key-value store %s", store.Name())
+	}
+	outType := reflect.TypeOf(out)
+	for key, rawValue := range pairs {
+		relativeKey := strings.Trim(strings.TrimPrefix(key, prefix), "/")
+		if relativeKey == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+		keyPath := strings.Split(relativeKey, "/")
+		var value interface{} = rawValue
+		if fieldType, ok := configFieldType(outType, keyPath); ok {
+			value, err = coerceConfigString(rawValue, fieldType)
+			if err != nil {
+				return errors.Wrapf(err, "key-value store %s: key %s", store.Name(), key)
+			}
+		}
+		setConfigValue(configData, keyPath, value)
+		sources.set(strings.Join(keyPath, "."), ConfigSource{Layer: LayerRemote, Location: store.Name() + " " + key})
+	}
+	return nil
+}
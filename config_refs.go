@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// $${file:...} and $${env:...} are kept as literals, like escaped key references.
+var secretRefRegexp = regexp.MustCompile(`\$?\$\{(file|env):([^}]*)\}`)
+
+// resolveSecretRefs replaces ${file:/path} and ${env:NAME} references in string values,
+// paths of the resolved keys are added to resolved. It runs after interpolation,
+// so resolved secrets are never scanned for key references.
+func resolveSecretRefs(data map[string]interface{}, keyPath string, resolved map[string]bool) error {
+	for k, v := range data {
+		value, err := resolveSecretRefsValue(v, joinKeyPath(keyPath, k), resolved)
+		if err != nil {
+			return err
+		}
+		data[k] = value
+	}
+	return nil
+}
+
+func resolveSecretRefsValue(value interface{}, keyPath string, resolved map[string]bool) (interface{}, error) {
+	switch item := value.(type) {
+	case map[string]interface{}:
+		return item, resolveSecretRefs(item, keyPath, resolved)
+	case []interface{}:
+		for i, element := range item {
+			resolvedElement, err := resolveSecretRefsValue(element, joinKeyPath(keyPath, strconv.Itoa(i)), resolved)
+			if err != nil {
+				return nil, err
+			}
+			item[i] = resolvedElement
+		}
+		return item, nil
+	case string:
+		if !secretRefRegexp.MatchString(item) {
+			return item, nil
+		}
+		var resolveErr error
+		isSecret := false
+		result := secretRefRegexp.ReplaceAllStringFunc(item, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+			isSecret = true
+			match := secretRefRegexp.FindStringSubmatch(ref)
+			secret, err := resolveSecretRef(match[1], match[2])
+			if err != nil && resolveErr == nil {
+				resolveErr = errors.Wrapf(err, "key %s", keyPath)
+			}
+			return secret
+		})
+		if resolveErr != nil {
+			return nil, resolveErr
+		}
+		if isSecret {
+			resolved[keyPath] = true
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+func resolveSecretRef(kind, name string) (string, error) {
+	switch kind {
+	case "file":
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", errors.Wrap(err, "read secret file")
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.Errorf("env variable %s is not set", name)
+		}
+		return value, nil
+	default:
+		return "", errors.Errorf("unknown secret reference kind: %s", kind)
+	}
+}
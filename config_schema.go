@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTag     = "default"
+	descriptionTag = "description"
+
+	jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+	hostPortPattern = `^[^:\s]+:[0-9]{1,5}$`
+	refPattern      = `\$\{[^}]+\}`
+)
+
+// ConfigSchema generates a JSON Schema of the merged config tree described by config yaml, validate, default,
+// secret and description struct tags. Single config files are partial layers, use ConfigLayerSchema for them.
+func ConfigSchema(config interface{}) map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(config), map[reflect.Type]bool{}, false)
+	schema["$schema"] = jsonSchemaDraft
+	return schema
+}
+
+func ConfigSchemaJSON(config interface{}) ([]byte, error) {
+	b, err := json.MarshalIndent(ConfigSchema(config), "", "  ")
+	return b, errors.Wrap(err, "json marshal schema")
+}
+
+// ConfigLayerSchema generates a JSON Schema of a single config file: main files for an empty key,
+// other files, e.g. mongo.yaml for "mongo", describe the section they're merged into.
+// No key is required, include directives, merge marks (key!, key+) and ${...} references are accepted.
+func ConfigLayerSchema(config interface{}, key string) (map[string]interface{}, error) {
+	t := reflect.TypeOf(config)
+	if key != "" {
+		var ok bool
+		t, ok = configFieldType(t, strings.Split(key, "."))
+		if !ok {
+			return nil, errors.Errorf("unknown config key: %s", key)
+		}
+	}
+	schema := typeSchema(t, map[reflect.Type]bool{}, true)
+	if schema["type"] == "object" {
+		properties, ok := schema["properties"].(map[string]interface{})
+		if !ok {
+			properties = map[string]interface{}{}
+			schema["properties"] = properties
+		}
+		properties[includeKey] = map[string]interface{}{"anyOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		}}
+	}
+	schema["$schema"] = jsonSchemaDraft
+	return schema, nil
+}
+
+func ConfigLayerSchemaJSON(config interface{}, key string) ([]byte, error) {
+	schema, err := ConfigLayerSchema(config, key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(schema, "", "  ")
+	return b, errors.Wrap(err, "json marshal schema")
+}
+
+// layerValueSchema accepts a ${...} reference in place of any value of a layer file.
+func layerValueSchema(schema map[string]interface{}, layer bool) map[string]interface{} {
+	if !layer {
+		return schema
+	}
+	result := map[string]interface{}{"anyOf": []interface{}{
+		schema, map[string]interface{}{"type": "string", "pattern": refPattern},
+	}}
+	if description, ok := schema["description"]; ok {
+		result["description"] = description
+	}
+	return result
+}
+
+func typeSchema(t reflect.Type, visiting map[reflect.Type]bool, layer bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return map[string]interface{}{"type": "string"}
+	}
+	if t == durationType {
+		return map[string]interface{}{"type": []string{"string", "integer"}}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": layerValueSchema(typeSchema(t.Elem(), visiting, layer), layer)}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type": "object", "additionalProperties": layerValueSchema(typeSchema(t.Elem(), visiting, layer), layer),
+		}
+	case reflect.Struct:
+		if visiting[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		schema := map[string]interface{}{"type": "object", "additionalProperties": false}
+		properties := map[string]interface{}{}
+		var required []string
+		structSchema(t, schema, properties, &required, visiting, layer)
+		schema["properties"] = properties
+		if len(required) != 0 && !layer {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func structSchema(t reflect.Type, schema, properties map[string]interface{}, required *[]string,
+	visiting map[reflect.Type]bool, layer bool) {
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline, skip := configFieldName(field)
+		if skip {
+			continue
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if inline {
+			switch fieldType.Kind() {
+			case reflect.Struct:
+				structSchema(fieldType, schema, properties, required, visiting, layer)
+			case reflect.Map:
+				schema["additionalProperties"] = layerValueSchema(typeSchema(fieldType.Elem(), visiting, layer), layer)
+			}
+			continue
+		}
+		fieldSchema := typeSchema(fieldType, visiting, layer)
+		if description := field.Tag.Get(descriptionTag); description != "" {
+			fieldSchema["description"] = description
+		}
+		if defaultValue, ok := field.Tag.Lookup(defaultTag); ok {
+			value, err := coerceConfigString(defaultValue, fieldType)
+			if err == nil {
+				fieldSchema["default"] = value
+			}
+		}
+		if isSecretField(field) {
+			fieldSchema["writeOnly"] = true
+		}
+		if field.Tag.Get(unitTag) != "" {
+			fieldSchema["type"] = []string{"string", "integer"}
+		}
+		for _, rule := range strings.Split(field.Tag.Get(validateTag), ",") {
+			ruleName, ruleArg := splitValidationRule(rule)
+			if ruleName == "required" {
+				*required = append(*required, name)
+				continue
+			}
+			applyRuleSchema(fieldSchema, fieldType, ruleName, ruleArg)
+		}
+		properties[name] = layerValueSchema(fieldSchema, layer)
+		if layer {
+			properties[name+replaceMark] = properties[name]
+			if fieldType.Kind() == reflect.Slice {
+				properties[name+appendMark] = properties[name]
+			}
+		}
+	}
+}
+
+func applyRuleSchema(schema map[string]interface{}, t reflect.Type, rule, arg string) {
+	switch rule {
+	case "nonempty":
+		switch t.Kind() {
+		case reflect.String:
+			schema["minLength"] = 1
+		case reflect.Slice, reflect.Array:
+			schema["minItems"] = 1
+		case reflect.Map:
+			schema["minProperties"] = 1
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return
+		}
+		var key string
+		switch t.Kind() {
+		case reflect.String:
+			key = rule + "Length"
+		case reflect.Slice, reflect.Array:
+			key = rule + "Items"
+		case reflect.Map:
+			key = rule + "Properties"
+		default:
+			key = map[string]string{"min": "minimum", "max": "maximum"}[rule]
+		}
+		schema[key] = limit
+	case "oneof":
+		var options []interface{}
+		for _, option := range strings.Fields(arg) {
+			value, err := coerceConfigString(option, t)
+			if err != nil {
+				continue
+			}
+			options = append(options, value)
+		}
+		schema["enum"] = options
+	case "url":
+		schema["format"] = "uri"
+	case "hostport":
+		schema["pattern"] = hostPortPattern
+	}
+}
+
+// WriteConfigReference writes a markdown table describing every leaf key of config.
+func WriteConfigReference(w io.Writer, config interface{}) error {
+	_, err := fmt.Fprintln(w, "| Key | Type | Default | Validation | Description |\n|---|---|---|---|---|")
+	if err != nil {
+		return errors.Wrap(err, "write reference")
+	}
+	return writeReferenceRows(w, reflect.TypeOf(config), "", map[reflect.Type]bool{})
+}
+
+func writeReferenceRows(w io.Writer, t reflect.Type, keyPath string, visiting map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline, skip := configFieldName(field)
+		if skip {
+			continue
+		}
+		fieldPath := keyPath
+		if !inline {
+			fieldPath = joinKeyPath(keyPath, name)
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct && !isConfigLeafType(fieldType) {
+			err := writeReferenceRows(w, fieldType, fieldPath, visiting)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if inline {
+			continue
+		}
+		description := field.Tag.Get(descriptionTag)
+		if isSecretField(field) {
+			description = strings.TrimSpace("Secret. " + description)
+		}
+		typeName := fieldType.String()
+		if unit := field.Tag.Get(unitTag); unit != "" {
+			typeName += " (" + unit + ")"
+		}
+		_, err := fmt.Fprintf(w, "| `%s` | %s | %s | %s | %s |\n", fieldPath, typeName,
+			markdownCode(field.Tag.Get(defaultTag)), markdownCode(field.Tag.Get(validateTag)), description)
+		if err != nil {
+			return errors.Wrap(err, "write reference")
+		}
+	}
+	return nil
+}
+
+func markdownCode(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "`" + value + "`"
+}
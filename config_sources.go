@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	LayerGeneral      = "general"
+	LayerGeneralLocal = "general.local"
+	LayerEnv          = "env"
+	LayerEnvLocal     = "env.local"
+	LayerOverride     = "override"
+)
+
+type ConfigSource struct {
+	Layer    string
+	Location string
+}
+
+func (self ConfigSource) String() string {
+	if self.Layer == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s", self.Layer, self.Location)
+}
+
+// ConfigSources maps dotted leaf keys like "mongo.host" to the layer that produced their final value.
+type ConfigSources map[string]ConfigSource
+
+func (self ConfigSources) record(keyPath string, data map[string]interface{}, source ConfigSource) {
+	for k, v := range data {
+		key := strings.TrimSuffix(strings.TrimSuffix(k, replaceMark), appendMark)
+		childPath := joinKeyPath(keyPath, key)
+		valueMap, isMap := v.(map[string]interface{})
+		if strings.HasSuffix(k, replaceMark) || !isMap {
+			self.forget(childPath)
+		}
+		if isMap {
+			self.record(childPath, valueMap, source)
+		} else {
+			self[childPath] = source
+		}
+	}
+}
+
+func (self ConfigSources) set(keyPath string, source ConfigSource) {
+	self.forget(keyPath)
+	self[keyPath] = source
+}
+
+func (self ConfigSources) forget(keyPath string) {
+	for k := range self {
+		if strings.HasPrefix(k, keyPath+".") {
+			delete(self, k)
+		}
+	}
+}
+
+func (self ConfigSources) has(keyPath string) bool {
+	_, ok := self.find(keyPath)
+	return ok
+}
+
+// find returns the source of keyPath, or of one of its leaves if keyPath is a subtree.
+func (self ConfigSources) find(keyPath string) (ConfigSource, bool) {
+	if source, ok := self[keyPath]; ok {
+		return source, true
+	}
+	var leaves []string
+	for k := range self {
+		if strings.HasPrefix(k, keyPath+".") {
+			leaves = append(leaves, k)
+		}
+	}
+	if len(leaves) == 0 {
+		return ConfigSource{}, false
+	}
+	sort.Strings(leaves)
+	return self[leaves[0]], true
+}
+
+// Sources returns provenance of every leaf key from the last Parse call.
+func (self *ConfigParser) Sources() ConfigSources {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.sources
+}
+
+// Explain writes the config tree merged by the last Parse call, every leaf is annotated with its source.
+// Values of fields tagged as secret in the parsed struct are redacted.
+func (self *ConfigParser) Explain(w io.Writer) error {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if self.data == nil {
+		return errors.New("config is not parsed yet")
+	}
+	return writeExplainedTree(w, self.data, "", 0, self.sources, self.secrets)
+}
+
+func writeExplainedTree(w io.Writer, data map[string]interface{}, keyPath string, depth int,
+	sources ConfigSources, secrets map[string]bool) error {
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	indent := strings.Repeat("  ", depth)
+	for _, k := range keys {
+		childPath := joinKeyPath(keyPath, k)
+		if valueMap, ok := data[k].(map[string]interface{}); ok {
+			_, err := fmt.Fprintf(w, "%s%s:\n", indent, k)
+			if err != nil {
+				return errors.Wrap(err, "write explain")
+			}
+			err = writeExplainedTree(w, valueMap, childPath, depth+1, sources, secrets)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		value := data[k]
+		if secrets[childPath] && value != nil && value != "" {
+			value = RedactedValue
+		}
+		_, err := fmt.Fprintf(w, "%s%s: %s  # %s\n", indent, k, ObjToString(value), sources[childPath])
+		if err != nil {
+			return errors.Wrap(err, "write explain")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestParseConfigMergeMarksAcrossLayers(t *testing.T) {
+	main := "admins: [1, 2]\nmongo: {host: a, port: 1}\n"
+	tests := []struct {
+		name   string
+		files  fstest.MapFS
+		admins []interface{}
+		mongo  map[string]interface{}
+	}{
+		{
+			name: "env file",
+			files: fstest.MapFS{
+				"main.yaml":      {Data: []byte(main)},
+				"prod/main.yaml": {Data: []byte("admins+: [3]\nmongo!: {host: b}\n")},
+			},
+			admins: []interface{}{1, 2, 3},
+			mongo:  map[string]interface{}{"host": "b"},
+		},
+		{
+			name: "env file with include",
+			files: fstest.MapFS{
+				"main.yaml":                  {Data: []byte(main)},
+				"prod/main.yaml":             {Data: []byte("include: fragments/admins.yaml\nadmins+: [3]\nmongo!: {host: b}\n")},
+				"prod/fragments/admins.yaml": {Data: []byte("admins+: [4]\n")},
+			},
+			admins: []interface{}{1, 2, 4, 3},
+			mongo:  map[string]interface{}{"host": "b"},
+		},
+		{
+			name: "marks in included file",
+			files: fstest.MapFS{
+				"main.yaml":                 {Data: []byte(main)},
+				"prod/main.yaml":            {Data: []byte("include: fragments/mongo.yaml\nadmins+: [3]\n")},
+				"prod/fragments/mongo.yaml": {Data: []byte("mongo!: {host: c}\nadmins+: [5]\n")},
+			},
+			admins: []interface{}{1, 2, 5, 3},
+			mongo:  map[string]interface{}{"host": "c"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := map[string]interface{}{}
+			err := ParseConfig(".", config, func(o *ConfigParserOptions) {
+				o.Env = "prod"
+				o.FS = test.files
+			})
+			if err != nil {
+				t.Fatalf("parse: %+v", err)
+			}
+			if !reflect.DeepEqual(config["admins"], test.admins) {
+				t.Errorf("admins: got %v, want %v", config["admins"], test.admins)
+			}
+			if !reflect.DeepEqual(config["mongo"], test.mongo) {
+				t.Errorf("mongo: got %v, want %v", config["mongo"], test.mongo)
+			}
+		})
+	}
+}
+
+func TestParseConfigTomlArraysOfTables(t *testing.T) {
+	files := fstest.MapFS{
+		"main.toml":      {Data: []byte("[[servers]]\nhost = \"a\"\nport = 1\n\n[[servers]]\nhost = \"b\"\nport = 2\n")},
+		"prod/main.toml": {Data: []byte("started = 2018-08-15T10:47:33Z\n")},
+	}
+	var config struct {
+		Started time.Time `yaml:"started"`
+		Servers []struct {
+			Host string `yaml:"host"`
+			Port int    `yaml:"port"`
+		} `yaml:"servers"`
+	}
+	err := ParseConfig(".", &config, func(o *ConfigParserOptions) {
+		o.Env = "prod"
+		o.FS = files
+		o.DetectExtension = true
+	})
+	if err != nil {
+		t.Fatalf("parse: %+v", err)
+	}
+	if len(config.Servers) != 2 || config.Servers[0].Host != "a" || config.Servers[1].Port != 2 {
+		t.Errorf("servers: got %+v", config.Servers)
+	}
+	if !config.Started.Equal(time.Date(2018, 8, 15, 10, 47, 33, 0, time.UTC)) {
+		t.Errorf("started: got %v", config.Started)
+	}
+}
@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const validateTag = "validate"
+
+type ValidationError struct {
+	Path    string
+	Rule    string
+	Message string
+	Source  string
+}
+
+func (self *ValidationError) Error() string {
+	source := self.Source
+	if source == "" {
+		source = "not set"
+	}
+	return fmt.Sprintf("%s: %s (%s)", self.Path, self.Message, source)
+}
+
+type ValidationErrors []*ValidationError
+
+func (self ValidationErrors) Error() string {
+	messages := make([]string, len(self))
+	for i, err := range self {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("config validation failed:\n\t%s", strings.Join(messages, "\n\t"))
+}
+
+// ValidateConfig checks "validate" struct tags of config, all violations are returned together as ValidationErrors.
+// Supported rules: required, nonempty, min=N, max=N, oneof=a b c, url, hostport.
+// Except required and nonempty, rules are skipped for zero values.
+func ValidateConfig(config interface{}) error {
+	return validateConfig(config, nil)
+}
+
+// validateConfig treats a field as required-satisfied if some layer supplied it, when sources are known.
+func validateConfig(config interface{}, sources ConfigSources) error {
+	var errs ValidationErrors
+	validateValue(reflect.ValueOf(config), "", sources, &errs)
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateValue(value reflect.Value, keyPath string, sources ConfigSources, errs *ValidationErrors) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		name, inline, skip := configFieldName(field)
+		if skip {
+			continue
+		}
+		fieldPath := keyPath
+		if !inline {
+			fieldPath = joinKeyPath(keyPath, name)
+		}
+		fieldValue := value.Field(i)
+		if tag := field.Tag.Get(validateTag); tag != "" {
+			for _, rule := range strings.Split(tag, ",") {
+				ruleName, ruleArg := splitValidationRule(rule)
+				message := checkValidationRule(ruleName, ruleArg, fieldValue, fieldPath, sources)
+				if message != "" {
+					*errs = append(*errs, &ValidationError{
+						Path: fieldPath, Rule: ruleName, Message: message, Source: sources[fieldPath].String()})
+					// other rules would only report the same missing value again
+					if ruleName == "required" {
+						break
+					}
+				}
+			}
+		}
+		validateValue(fieldValue, fieldPath, sources, errs)
+	}
+}
+
+func splitValidationRule(rule string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func checkValidationRule(rule, arg string, value reflect.Value, keyPath string, sources ConfigSources) string {
+	switch rule {
+	case "required":
+		if sources != nil {
+			if !sources.has(keyPath) {
+				return "is required"
+			}
+			return ""
+		}
+		if isZeroValue(value) {
+			return "is required"
+		}
+		return ""
+	case "nonempty":
+		if isZeroValue(value) {
+			return "must not be empty"
+		}
+		return ""
+	}
+	if isZeroValue(value) {
+		return ""
+	}
+	switch rule {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid %s rule argument %q", rule, arg)
+		}
+		size, isLength, ok := validationSize(value)
+		if !ok {
+			return fmt.Sprintf("rule %s is not applicable to %s", rule, value.Type())
+		}
+		if rule == "min" && size < limit {
+			if isLength {
+				return fmt.Sprintf("length must be at least %s", arg)
+			}
+			return fmt.Sprintf("must be at least %s", arg)
+		}
+		if rule == "max" && size > limit {
+			if isLength {
+				return fmt.Sprintf("length must be at most %s", arg)
+			}
+			return fmt.Sprintf("must be at most %s", arg)
+		}
+	case "oneof":
+		actual := fmt.Sprintf("%v", value.Interface())
+		for _, option := range strings.Fields(arg) {
+			if option == actual {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of [%s], got %q", arg, actual)
+	case "url":
+		u, err := url.Parse(fmt.Sprintf("%v", value.Interface()))
+		if err != nil {
+			return errors.Wrap(err, "must be a valid url").Error()
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return "must be an absolute url"
+		}
+	case "hostport":
+		host, port, err := net.SplitHostPort(fmt.Sprintf("%v", value.Interface()))
+		if err != nil {
+			return errors.Wrap(err, "must be host:port").Error()
+		}
+		portNum, err := strconv.Atoi(port)
+		if host == "" || err != nil || portNum <= 0 || portNum > 65535 {
+			return "must be host:port"
+		}
+	default:
+		return fmt.Sprintf("unknown validation rule %q", rule)
+	}
+	return ""
+}
+
+func isZeroValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	default:
+		return value.IsZero()
+	}
+}
+
+func validationSize(value reflect.Value) (float64, bool, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), false, true
+	case reflect.String, reflect.Slice, reflect.Map:
+		return float64(value.Len()), true, true
+	default:
+		return 0, false, false
+	}
+}
@@ -0,0 +1,16 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestValidateConfigReportsMissingValueOnce(t *testing.T) {
+	config := &struct {
+		Token string `yaml:"token" validate:"required,nonempty"`
+	}{}
+	err := ValidateConfig(config)
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Rule != "required" {
+		t.Errorf("got %v", err)
+	}
+}
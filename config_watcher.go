@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gazoon/go-utils/logging"
+	"github.com/pkg/errors"
+)
+
+var (
+	watcherLogger = logging.WithPackage("config_watcher")
+)
+
+type ConfigChangeHandler func(oldConfig, newConfig interface{})
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// ConfigWatcher polls config directories and re-parses the config when any file changes.
+// Subscribers are notified only if the new config is parsed and validated successfully.
+type ConfigWatcher struct {
+	parser     *ConfigParser
+	configType reflect.Type
+	interval   time.Duration
+
+	mutex    sync.RWMutex
+	current  interface{}
+	handlers []ConfigChangeHandler
+	stopFlag int32
+
+	// serializes checks, guards files
+	checkMutex sync.Mutex
+	files      map[string]fileState
+}
+
+// NewConfigWatcher parses the initial config into config, which must be a pointer to a struct.
+// checkInterval is in milliseconds.
+func NewConfigWatcher(parser *ConfigParser, config interface{}, checkInterval int) (*ConfigWatcher, error) {
+	configType := reflect.TypeOf(config)
+	if configType == nil || configType.Kind() != reflect.Ptr {
+		return nil, errors.New("config watcher requires a pointer to config")
+	}
+	err := parser.Parse(config)
+	if err != nil {
+		return nil, err
+	}
+	// snapshot after parsing, so that included files are known
+	files, err := parser.snapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigWatcher{
+		parser: parser, configType: configType, interval: time.Duration(checkInterval) * time.Millisecond,
+		current: config, files: files,
+	}, nil
+}
+
+func (self *ConfigWatcher) Current() interface{} {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.current
+}
+
+func (self *ConfigWatcher) Subscribe(handler ConfigChangeHandler) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.handlers = append(self.handlers, handler)
+}
+
+func (self *ConfigWatcher) Run() {
+	go self.runLoop()
+}
+
+func (self *ConfigWatcher) Stop() {
+	atomic.StoreInt32(&self.stopFlag, 1)
+}
+
+func (self *ConfigWatcher) runLoop() {
+	for {
+		time.Sleep(self.interval)
+		if atomic.LoadInt32(&self.stopFlag) == 1 {
+			return
+		}
+		err := self.Check()
+		if err != nil {
+			watcherLogger.Errorf("Can't reload config: %+v", err)
+		}
+	}
+}
+
+// Check re-parses the config if any file has changed since the previous check.
+func (self *ConfigWatcher) Check() error {
+	self.checkMutex.Lock()
+	defer self.checkMutex.Unlock()
+	files, err := self.parser.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	// remote layers can't be tracked by files, so the config is re-parsed on every check
+	if reflect.DeepEqual(files, self.files) && self.parser.options.KeyValueStore == nil {
+		return nil
+	}
+	newConfig := reflect.New(self.configType.Elem()).Interface()
+	err = self.parser.Parse(newConfig)
+	if err != nil {
+		return err
+	}
+	// included files may change with the new config
+	files, err = self.parser.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	self.files = files
+
+	self.mutex.Lock()
+	oldConfig := self.current
+	if reflect.DeepEqual(oldConfig, newConfig) {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.current = newConfig
+	handlers := append([]ConfigChangeHandler(nil), self.handlers...)
+	self.mutex.Unlock()
+
+	watcherLogger.WithField("handlers", len(handlers)).Info("Config changed, notify subscribers")
+	for _, handler := range handlers {
+		handler(oldConfig, newConfig)
+	}
+	return nil
+}
+
+func (self *ConfigParser) snapshotFiles() (map[string]fileState, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	envs, err := self.resolveEnvs()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]fileState{}
+	for _, root := range self.roots {
+		for _, dirPath := range root.dirs(envs) {
+			dirFiles, err := root.readDir(dirPath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, errors.Wrap(err, "get config dir files")
+			}
+			for _, info := range dirFiles {
+				if info.IsDir() {
+					continue
+				}
+				filePath := root.location(path.Join(dirPath, info.Name()))
+				files[filePath] = fileState{modTime: info.ModTime(), size: info.Size()}
+			}
+		}
+	}
+	for filePath := range self.includedFiles {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "get included file info")
+		}
+		files[filePath] = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	return files, nil
+}
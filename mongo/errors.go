@@ -0,0 +1,141 @@
+package mongo
+
+import (
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/pkg/errors"
+)
+
+const (
+	hostUnreachableCode           = 6
+	hostNotFoundCode              = 7
+	cursorNotFoundCode            = 43
+	maxTimeExpiredCode            = 50
+	writeConcernFailedCode        = 64
+	networkTimeoutCode            = 89
+	shutdownInProgressCode        = 91
+	unsatisfiableWriteConcernCode = 100
+	primarySteppedDownCode        = 189
+	notMasterCode                 = 10107
+	interruptedAtShutdownCode     = 11600
+	interruptedReplChangeCode     = 11602
+	notMasterNoSlaveOkCode        = 13435
+	notMasterOrSecondaryCode      = 13436
+)
+
+var (
+	duplicateKeyIndexRegexp = regexp.MustCompile(`index: (?:\S+\.\$)?(\S+)\s+dup key`)
+	networkErrMessages      = []string{"no reachable servers", "connection reset", "broken pipe", "i/o timeout"}
+	notPrimaryErrMessages   = []string{"not master", "node is recovering", "not primary"}
+)
+
+// errorCode returns the server error code of err, or of the first failed bulk operation.
+func errorCode(err error) (int, bool) {
+	switch mgoErr := errors.Cause(err).(type) {
+	case *mgo.LastError:
+		return mgoErr.Code, mgoErr.Code != 0
+	case *mgo.QueryError:
+		return mgoErr.Code, mgoErr.Code != 0
+	case *mgo.BulkError:
+		for _, errCase := range mgoErr.Cases() {
+			if code, ok := errorCode(errCase.Err); ok {
+				return code, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func hasErrorCode(err error, codes ...int) bool {
+	code, ok := errorCode(err)
+	if !ok {
+		return false
+	}
+	for _, c := range codes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+func hasErrorMessage(err error, messages []string) bool {
+	text := strings.ToLower(errors.Cause(err).Error())
+	for _, message := range messages {
+		if strings.Contains(text, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNetworkErr reports connection failures and timeouts.
+func IsNetworkErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := cause.(net.Error); ok {
+		return true
+	}
+	return hasErrorCode(err, hostUnreachableCode, hostNotFoundCode, maxTimeExpiredCode, networkTimeoutCode) ||
+		hasErrorMessage(err, networkErrMessages)
+}
+
+// IsNotPrimaryErr reports errors caused by a primary step-down or a node shutdown during failover.
+func IsNotPrimaryErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	return hasErrorCode(err, notMasterCode, notMasterNoSlaveOkCode, notMasterOrSecondaryCode, primarySteppedDownCode,
+		shutdownInProgressCode, interruptedAtShutdownCode, interruptedReplChangeCode) ||
+		hasErrorMessage(err, notPrimaryErrMessages)
+}
+
+// IsWriteConcernErr reports writes that were not acknowledged by the requested write concern,
+// the write itself may be applied.
+func IsWriteConcernErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if lastErr, ok := errors.Cause(err).(*mgo.LastError); ok && lastErr.WTimeout {
+		return true
+	}
+	return hasErrorCode(err, writeConcernFailedCode, unsatisfiableWriteConcernCode)
+}
+
+func IsCursorNotFoundErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Cause(err) == mgo.ErrCursor || hasErrorCode(err, cursorNotFoundCode) ||
+		hasErrorMessage(err, []string{"cursor not found"})
+}
+
+// IsTransientErr reports errors after which an idempotent operation can be safely retried.
+func IsTransientErr(err error) bool {
+	return IsNetworkErr(err) || IsNotPrimaryErr(err) || IsCursorNotFoundErr(err)
+}
+
+func IsDuplicationErr(err error) bool {
+	return err != nil && mgo.IsDup(errors.Cause(err))
+}
+
+// DuplicateKeyIndex extracts the name of the unique index violated by a duplicate key error.
+func DuplicateKeyIndex(err error) (string, bool) {
+	if !IsDuplicationErr(err) {
+		return "", false
+	}
+	match := duplicateKeyIndexRegexp.FindStringSubmatch(errors.Cause(err).Error())
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
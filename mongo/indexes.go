@@ -0,0 +1,288 @@
+package mongo
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+)
+
+const (
+	namespaceNotFoundCode = 26
+	idIndexName           = "_id_"
+
+	IndexCreate   = "create"
+	IndexDrop     = "drop"
+	IndexExtra    = "extra"
+	IndexMismatch = "mismatch"
+)
+
+var DefaultIndexes = NewIndexRegistry()
+
+// IndexSpec describes a desired index, Key uses mgo notation: "field" or "-field" for descending order.
+type IndexSpec struct {
+	Key           []string
+	Name          string
+	Unique        bool
+	Sparse        bool
+	ExpireAfter   time.Duration
+	PartialFilter bson.M
+}
+
+func (self IndexSpec) String() string {
+	if self.Name != "" {
+		return self.Name
+	}
+	return strings.Join(self.Key, ",")
+}
+
+func (self IndexSpec) index() mgo.Index {
+	return mgo.Index{
+		Key: self.Key, Name: self.Name, Unique: self.Unique, Sparse: self.Sparse,
+		ExpireAfter: self.ExpireAfter, PartialFilter: self.PartialFilter,
+	}
+}
+
+// mismatch describes how an existing index with the same key differs from the spec.
+func (self IndexSpec) mismatch(existing mgo.Index) string {
+	var diffs []string
+	if self.Name != "" && self.Name != existing.Name {
+		diffs = append(diffs, fmt.Sprintf("name %s, want %s", existing.Name, self.Name))
+	}
+	if self.Unique != existing.Unique {
+		diffs = append(diffs, fmt.Sprintf("unique %t, want %t", existing.Unique, self.Unique))
+	}
+	if self.Sparse != existing.Sparse {
+		diffs = append(diffs, fmt.Sprintf("sparse %t, want %t", existing.Sparse, self.Sparse))
+	}
+	if self.ExpireAfter.Truncate(time.Second) != existing.ExpireAfter {
+		diffs = append(diffs, fmt.Sprintf("expire after %s, want %s", existing.ExpireAfter, self.ExpireAfter))
+	}
+	if !reflect.DeepEqual(normalizeFilter(self.PartialFilter), normalizeFilter(existing.PartialFilter)) {
+		diffs = append(diffs, fmt.Sprintf("partial filter %v, want %v", existing.PartialFilter, self.PartialFilter))
+	}
+	return strings.Join(diffs, "; ")
+}
+
+// normalizeFilter makes filters comparable: a bson round trip unifies document types
+// and numbers are compared as float64 whatever type the server has stored them with.
+func normalizeFilter(filter bson.M) interface{} {
+	if len(filter) == 0 {
+		return nil
+	}
+	b, err := bson.Marshal(filter)
+	if err != nil {
+		return filter
+	}
+	var result bson.M
+	err = bson.Unmarshal(b, &result)
+	if err != nil {
+		return filter
+	}
+	return normalizeFilterValue(result)
+}
+
+func normalizeFilterValue(value interface{}) interface{} {
+	switch item := value.(type) {
+	case bson.M:
+		result := make(map[string]interface{}, len(item))
+		for k, v := range item {
+			result[k] = normalizeFilterValue(v)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(item))
+		for i, v := range item {
+			result[i] = normalizeFilterValue(v)
+		}
+		return result
+	case int:
+		return float64(item)
+	case int64:
+		return float64(item)
+	default:
+		return value
+	}
+}
+
+type IndexChange struct {
+	Collection string
+	Index      string
+	Action     string
+	Details    string
+	Applied    bool
+}
+
+func (self IndexChange) String() string {
+	status := "planned"
+	if self.Applied {
+		status = "applied"
+	}
+	if self.Action == IndexExtra || self.Action == IndexMismatch {
+		status = "needs attention"
+	}
+	result := fmt.Sprintf("%s %s.%s (%s)", self.Action, self.Collection, self.Index, status)
+	if self.Details != "" {
+		result += ": " + self.Details
+	}
+	return result
+}
+
+type IndexReport []IndexChange
+
+func (self IndexReport) Write(w io.Writer) error {
+	if len(self) == 0 {
+		_, err := fmt.Fprintln(w, "Indexes are in sync")
+		return errors.Wrap(err, "write index report")
+	}
+	for _, change := range self {
+		_, err := fmt.Fprintln(w, change)
+		if err != nil {
+			return errors.Wrap(err, "write index report")
+		}
+	}
+	return nil
+}
+
+type IndexSyncOptions struct {
+	// Only report the changes, nothing is created or dropped.
+	DryRun bool
+	// Drop indexes that aren't registered, otherwise they're reported as extra.
+	DropExtra bool
+}
+
+// IndexRegistry collects index specs of all components, so that a single sync sees the full set of indexes
+// of a collection shared by several components.
+type IndexRegistry struct {
+	mutex       sync.Mutex
+	collections map[string]*mgo.Collection
+	specs       map[string][]IndexSpec
+}
+
+func NewIndexRegistry() *IndexRegistry {
+	return &IndexRegistry{collections: map[string]*mgo.Collection{}, specs: map[string][]IndexSpec{}}
+}
+
+// Register adds specs of the collection, a spec with already registered key replaces the previous one.
+func (self *IndexRegistry) Register(collection *mgo.Collection, specs ...IndexSpec) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	name := collection.FullName
+	self.collections[name] = collection
+	for _, spec := range specs {
+		replaced := false
+		for i, registered := range self.specs[name] {
+			if reflect.DeepEqual(registered.Key, spec.Key) {
+				self.specs[name][i] = spec
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			self.specs[name] = append(self.specs[name], spec)
+		}
+	}
+}
+
+// Sync brings indexes of all registered collections to their specs.
+func (self *IndexRegistry) Sync(options IndexSyncOptions) (IndexReport, error) {
+	self.mutex.Lock()
+	names := make([]string, 0, len(self.collections))
+	for name := range self.collections {
+		names = append(names, name)
+	}
+	collections := make(map[string]*mgo.Collection, len(self.collections))
+	specs := make(map[string][]IndexSpec, len(self.specs))
+	for _, name := range names {
+		collections[name] = self.collections[name]
+		specs[name] = append([]IndexSpec(nil), self.specs[name]...)
+	}
+	self.mutex.Unlock()
+
+	sort.Strings(names)
+	var report IndexReport
+	for _, name := range names {
+		changes, err := SyncIndexes(collections[name], specs[name], options)
+		report = append(report, changes...)
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// SyncIndexes creates missing indexes of the collection and reports mismatched and extra ones,
+// indexes that differ only by options are never recreated automatically.
+func SyncIndexes(collection *mgo.Collection, specs []IndexSpec, options IndexSyncOptions) (IndexReport, error) {
+	var report IndexReport
+	err := WithSession(collection, func(collection *mgo.Collection) error {
+		existing, err := collection.Indexes()
+		if err != nil && !hasErrorCode(err, namespaceNotFoundCode) {
+			return errors.Wrapf(err, "list indexes of %s", collection.FullName)
+		}
+		matched := map[string]bool{}
+		for _, spec := range specs {
+			index, ok := findIndex(existing, spec.Key)
+			if ok {
+				matched[index.Name] = true
+				if details := spec.mismatch(index); details != "" {
+					report = append(report, IndexChange{
+						Collection: collection.FullName, Index: index.Name, Action: IndexMismatch, Details: details,
+					})
+				}
+				continue
+			}
+			change := IndexChange{Collection: collection.FullName, Index: spec.String(), Action: IndexCreate}
+			if !options.DryRun {
+				err := collection.EnsureIndex(spec.index())
+				if err != nil {
+					return errors.Wrapf(err, "create index %s of %s", spec, collection.FullName)
+				}
+				change.Applied = true
+			}
+			report = append(report, change)
+		}
+		for _, index := range existing {
+			if index.Name == idIndexName || matched[index.Name] {
+				continue
+			}
+			change := IndexChange{
+				Collection: collection.FullName, Index: index.Name, Action: IndexExtra,
+				Details: "key " + strings.Join(index.Key, ","),
+			}
+			if options.DropExtra {
+				change.Action = IndexDrop
+				if !options.DryRun {
+					err := collection.DropIndexName(index.Name)
+					if err != nil {
+						return errors.Wrapf(err, "drop index %s of %s", index.Name, collection.FullName)
+					}
+					change.Applied = true
+				}
+			}
+			report = append(report, change)
+		}
+		return nil
+	})
+	for _, change := range report {
+		log.Infof("Mongo index sync: %s", change)
+	}
+	return report, err
+}
+
+func findIndex(indexes []mgo.Index, key []string) (mgo.Index, bool) {
+	for _, index := range indexes {
+		if reflect.DeepEqual(index.Key, key) {
+			return index, true
+		}
+	}
+	return mgo.Index{}, false
+}
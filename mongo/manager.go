@@ -0,0 +1,123 @@
+package mongo
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/gazoon/go-utils"
+	"github.com/globalsign/mgo"
+	"github.com/pkg/errors"
+)
+
+var DefaultManager = NewManager()
+
+type managedSession struct {
+	ready   chan struct{}
+	session *mgo.Session
+	err     error
+}
+
+// Manager owns root sessions, components configured with the same connection settings share one root session
+// and its socket pool. Operations should run on per-operation sessions from Copy or Clone and close them afterwards.
+type Manager struct {
+	mutex    sync.Mutex
+	sessions map[string]*managedSession
+}
+
+func NewManager() *Manager {
+	return &Manager{sessions: map[string]*managedSession{}}
+}
+
+// Session returns the shared root session, dialing it on the first call for these settings.
+// The root session is closed by the manager, callers must not close it.
+func (self *Manager) Session(ctx context.Context, settings *utils.MongoDBSettings) (*mgo.Session, error) {
+	key, err := connectionKey(settings)
+	if err != nil {
+		return nil, err
+	}
+	self.mutex.Lock()
+	entry, ok := self.sessions[key]
+	if !ok {
+		entry = &managedSession{ready: make(chan struct{})}
+		self.sessions[key] = entry
+	}
+	self.mutex.Unlock()
+	if !ok {
+		entry.session, entry.err = Dial(ctx, settings)
+		if entry.err != nil {
+			self.mutex.Lock()
+			delete(self.sessions, key)
+			self.mutex.Unlock()
+		}
+		close(entry.ready)
+	}
+	select {
+	case <-entry.ready:
+		return entry.session, entry.err
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "wait for mongo connection")
+	}
+}
+
+// Copy returns a new session with the root session settings, it takes a fresh socket from the shared pool.
+func (self *Manager) Copy(ctx context.Context, settings *utils.MongoDBSettings) (*mgo.Session, error) {
+	session, err := self.Session(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+	return session.Copy(), nil
+}
+
+// Clone returns a new session that reuses the root session socket if it has one.
+func (self *Manager) Clone(ctx context.Context, settings *utils.MongoDBSettings) (*mgo.Session, error) {
+	session, err := self.Session(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+	return session.Clone(), nil
+}
+
+// Collection returns the settings collection bound to the shared root session.
+func (self *Manager) Collection(ctx context.Context, settings *utils.MongoDBSettings) (*mgo.Collection, error) {
+	if settings.Collection == "" {
+		return nil, errors.Errorf("can't connect to mongo collection: %s", utils.ObjToString(settings))
+	}
+	session, err := self.Session(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+	return session.DB("").C(settings.Collection), nil
+}
+
+// Close closes all root sessions, sessions copied from them must be closed by their owners.
+func (self *Manager) Close() {
+	self.mutex.Lock()
+	sessions := self.sessions
+	self.sessions = map[string]*managedSession{}
+	self.mutex.Unlock()
+	for _, entry := range sessions {
+		<-entry.ready
+		if entry.session != nil {
+			entry.session.Close()
+		}
+	}
+}
+
+// connectionKey identifies settings that can share a connection, the collection doesn't matter.
+func connectionKey(settings *utils.MongoDBSettings) (string, error) {
+	connectionSettings := *settings
+	connectionSettings.Collection = ""
+	b, err := json.Marshal(connectionSettings)
+	if err != nil {
+		return "", errors.Wrap(err, "mongo connection key")
+	}
+	return string(b), nil
+}
+
+// WithSession runs operation on a session copied from collection's session and closes it afterwards.
+func WithSession(collection *mgo.Collection, operation func(collection *mgo.Collection) error) error {
+	session := collection.Database.Session.Copy()
+	defer session.Close()
+	return operation(collection.With(session))
+}
@@ -1,51 +1,256 @@
 package mongo
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/gazoon/go-utils"
 	"github.com/globalsign/mgo"
 	"github.com/pkg/errors"
-	"strconv"
-	"time"
 )
 
-const (
-	duplicateKeyCode = 11000
-)
+var readModes = map[string]mgo.Mode{
+	"eventual":           mgo.Eventual,
+	"monotonic":          mgo.Monotonic,
+	"strong":             mgo.Strong,
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
 
 func ConnectCollection(settings *utils.MongoDBSettings) (*mgo.Collection, error) {
-	db, err := ConnectDatabase(settings)
+	return ConnectCollectionContext(context.Background(), settings)
+}
+
+func ConnectCollectionContext(ctx context.Context, settings *utils.MongoDBSettings) (*mgo.Collection, error) {
+	db, err := ConnectDatabaseContext(ctx, settings)
 	if err != nil {
 		return nil, err
 	}
 	if settings.Collection == "" {
-		return nil, errors.Errorf("can't connect to mongo collection: %+v", settings)
+		return nil, errors.Errorf("can't connect to mongo collection: %s", utils.ObjToString(settings))
 	}
 	return db.C(settings.Collection), nil
 }
 
 func ConnectDatabase(settings *utils.MongoDBSettings) (*mgo.Database, error) {
-	info := &mgo.DialInfo{
-		Addrs:     []string{settings.Host + ":" + strconv.Itoa(settings.Port)},
-		Database:  settings.Database,
-		Username:  settings.User,
-		Password:  settings.Password,
-		Timeout:   time.Duration(settings.Timeout) * time.Second,
-		PoolLimit: settings.PoolSize,
-	}
-	log.WithField("dial_info", fmt.Sprintf("%+v", info)).Info("Connecting to mongodb")
-	session, err := mgo.DialWithInfo(info)
+	return ConnectDatabaseContext(context.Background(), settings)
+}
+
+func ConnectDatabaseContext(ctx context.Context, settings *utils.MongoDBSettings) (*mgo.Database, error) {
+	session, err := Dial(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+	return session.DB(""), nil
+}
+
+// Dial connects up to RetriesNum+1 times, waiting between attempts as configured by the retries settings.
+func Dial(ctx context.Context, settings *utils.MongoDBSettings) (*mgo.Session, error) {
+	info, err := DialInfo(settings)
+	if err != nil {
+		return nil, err
+	}
+	safe, err := WriteConcern(settings)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"settings": utils.ObjToString(settings), "addrs": info.Addrs}).Info("Connecting to mongodb")
+	var session *mgo.Session
+	for attempt := 1; ; attempt++ {
+		session, err = mgo.DialWithInfo(info)
+		if err == nil {
+			break
+		}
+		if attempt > settings.RetriesNum {
+			return nil, errors.Wrapf(err, "mongo dial, %d attempts", attempt)
+		}
+		delay := retryDelay(&settings.DatabaseSettings, attempt)
+		log.WithFields(log.Fields{"attempt": attempt, "delay": delay}).Warnf("Can't connect to mongodb: %s", err)
+		err = sleepContext(ctx, delay)
+		if err != nil {
+			return nil, errors.Wrap(err, "mongo dial")
+		}
+	}
+	session.SetSafe(safe)
+	return session, nil
+}
+
+// retryDelay returns the pause after the failed attempt, counting from 1.
+// The backoff delay is jittered within its upper half so that clients don't retry in lockstep.
+func retryDelay(settings *utils.DatabaseSettings, attempt int) time.Duration {
+	delay := time.Duration(settings.RetriesInterval) * time.Millisecond
+	if !settings.RetriesBackoff || delay <= 0 {
+		return delay
+	}
+	maxDelay := time.Duration(settings.RetriesMaxInterval) * time.Millisecond
+	for i := 1; i < attempt && (maxDelay <= 0 || delay < maxDelay); i++ {
+		delay *= 2
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// WriteConcern returns the safety mode for settings, nil if acknowledgement is disabled.
+// Set fields override w, j and wtimeoutMS options of the URI, if neither of them sets a value
+// majority with journaling and Timeout as the write timeout are used.
+func WriteConcern(settings *utils.MongoDBSettings) (*mgo.Safe, error) {
+	options, err := uriOptions(settings.URI)
 	if err != nil {
-		return nil, errors.Wrap(err, "mongo dial")
+		return nil, err
+	}
+	safe := &mgo.Safe{WMode: "majority", J: true, WTimeout: settings.Timeout * 1000}
+	if w := options.Get("w"); w != "" {
+		safe.WMode = w
+	}
+	if settings.WriteConcern != "" {
+		safe.WMode = settings.WriteConcern
+	}
+	if w, err := strconv.Atoi(safe.WMode); err == nil {
+		if w == 0 {
+			return nil, nil
+		}
+		safe.WMode, safe.W = "", w
+	}
+	if j := options.Get("j"); j != "" {
+		safe.J, err = strconv.ParseBool(j)
+		if err != nil {
+			return nil, errors.Wrap(err, "mongo uri option j")
+		}
+	}
+	if settings.Journal != nil {
+		safe.J = *settings.Journal
+	}
+	if wtimeout := options.Get("wtimeoutMS"); wtimeout != "" {
+		safe.WTimeout, err = strconv.Atoi(wtimeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "mongo uri option wtimeoutMS")
+		}
+	}
+	if settings.WriteTimeout != 0 {
+		safe.WTimeout = settings.WriteTimeout
+	}
+	return safe, nil
+}
+
+// uriOptions returns query options of a mongodb:// URI, url.Parse can't handle its lists of hosts.
+func uriOptions(uri string) (url.Values, error) {
+	i := strings.Index(uri, "?")
+	if i == -1 {
+		return url.Values{}, nil
+	}
+	options, err := url.ParseQuery(strings.Replace(uri[i+1:], ";", "&", -1))
+	return options, errors.Wrap(err, "parse mongo uri options")
+}
+
+// DialInfo builds dial info from the settings URI, explicitly set settings fields override URI options.
+// The read mode is eventual if neither of them sets it.
+func DialInfo(settings *utils.MongoDBSettings) (*mgo.DialInfo, error) {
+	info := &mgo.DialInfo{ReadPreference: &mgo.ReadPreference{Mode: mgo.Eventual}}
+	if settings.URI != "" {
+		var err error
+		info, err = mgo.ParseURL(settings.URI)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse mongo uri")
+		}
+		options, err := uriOptions(settings.URI)
+		if err != nil {
+			return nil, err
+		}
+		if options.Get("readPreference") == "" {
+			info.ReadPreference.Mode = mgo.Eventual
+		}
+	}
+	var addrs []string
+	if settings.Host != "" {
+		addr := settings.Host
+		if settings.Port != 0 {
+			addr = net.JoinHostPort(settings.Host, strconv.Itoa(settings.Port))
+		}
+		addrs = append(addrs, addr)
+	}
+	addrs = append(addrs, settings.Hosts...)
+	if len(addrs) != 0 {
+		info.Addrs = addrs
+	}
+	if len(info.Addrs) == 0 {
+		return nil, errors.New("mongo settings contain neither uri nor hosts")
+	}
+	if settings.Database != "" {
+		info.Database = settings.Database
+	}
+	if settings.User != "" {
+		info.Username = settings.User
+	}
+	if settings.Password != "" {
+		info.Password = settings.Password
 	}
-	session.SetSafe(&mgo.Safe{WMode: "majority", J: true, WTimeout: settings.Timeout * 1000})
-	session.SetMode(mgo.Eventual, true)
-	db := session.DB("")
-	return db, nil
+	if settings.AuthSource != "" {
+		info.Source = settings.AuthSource
+	}
+	if settings.ReplicaSet != "" {
+		info.ReplicaSetName = settings.ReplicaSet
+	}
+	if settings.Timeout != 0 || info.Timeout == 0 {
+		info.Timeout = time.Duration(settings.Timeout) * time.Second
+	}
+	if settings.PoolSize != 0 {
+		info.PoolLimit = settings.PoolSize
+	}
+	if settings.ReadPreference != "" {
+		mode, ok := readModes[settings.ReadPreference]
+		if !ok {
+			return nil, errors.Errorf("unknown read preference: %s", settings.ReadPreference)
+		}
+		info.ReadPreference.Mode = mode
+	}
+	if settings.TLS || settings.TLSCAFile != "" || settings.TLSInsecure {
+		tlsConfig, err := tlsConfig(&settings.DatabaseSettings)
+		if err != nil {
+			return nil, err
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.Dial("tcp", addr.String(), tlsConfig)
+		}
+	}
+	return info, nil
 }
 
-func IsDuplicationErr(err error) bool {
-	mgoErr, ok := err.(*mgo.LastError)
-	return ok && mgoErr.Code == duplicateKeyCode
+func tlsConfig(settings *utils.DatabaseSettings) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: settings.TLSInsecure}
+	if settings.TLSCAFile != "" {
+		b, err := ioutil.ReadFile(settings.TLSCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read tls ca file")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificates in tls ca file %s", settings.TLSCAFile)
+		}
+	}
+	return config, nil
 }
@@ -0,0 +1,30 @@
+package mongo
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gazoon/go-utils"
+	"github.com/globalsign/mgo"
+	"github.com/pkg/errors"
+)
+
+type Operation func(attempt int) error
+
+// Retry runs an idempotent operation and retries it up to RetriesNum times on transient errors.
+// The session is refreshed before every retry, so that sockets to a stepped down primary are dropped.
+func Retry(ctx context.Context, session *mgo.Session, settings *utils.DatabaseSettings, operation Operation) error {
+	for attempt := 1; ; attempt++ {
+		err := operation(attempt)
+		if err == nil || !IsTransientErr(err) || attempt > settings.RetriesNum {
+			return err
+		}
+		delay := retryDelay(settings, attempt)
+		log.WithFields(log.Fields{"attempt": attempt, "delay": delay}).Warnf("Mongo operation failed, retry: %s", err)
+		sleepErr := sleepContext(ctx, delay)
+		if sleepErr != nil {
+			return errors.Wrapf(err, "retry interrupted: %s", sleepErr)
+		}
+		session.Refresh()
+	}
+}
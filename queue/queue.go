@@ -18,48 +18,83 @@ const (
 	maxProcessingTime = 20000
 )
 
+// Indexes of the queue collection, shared by writers and readers.
+var Indexes = []mongo.IndexSpec{
+	{Key: []string{"chat_id"}, Unique: true},
+	{Key: []string{"processing.id"}, Unique: true},
+	{Key: []string{"processing.started_at", "msgs.0.created_at"}},
+}
+
+// withSession runs operation on a session copied from the shared pool,
+// queue operations must see their own writes whatever read preference the pool uses.
+func withSession(collection *mgo.Collection, operation func(collection *mgo.Collection) error) error {
+	return mongo.WithSession(collection, func(collection *mgo.Collection) error {
+		collection.Database.Session.SetMode(mgo.Strong, true)
+		return operation(collection)
+	})
+}
+
 type MongoWriter struct {
-	client *mgo.Collection
+	client   *mgo.Collection
+	settings *utils.MongoDBSettings
 }
 
 func NewMongoWriter(settings *utils.MongoDBSettings) (*MongoWriter, error) {
 
-	client, err := mongo.ConnectCollection(settings)
+	client, err := mongo.DefaultManager.Collection(context.Background(), settings)
 	if err != nil {
 		return nil, err
 	}
-	return &MongoWriter{client: client}, nil
+	mongo.DefaultIndexes.Register(client, Indexes...)
+	return &MongoWriter{client: client, settings: settings}, nil
 }
 
 func (self *MongoWriter) Put(ctx context.Context, chatId int, message interface{}) error {
+	messageId := uuid.NewV4().String()
 	messageEnvelope := map[string]interface{}{
+		"id":         messageId,
 		"created_at": utils.TimestampMilliseconds(),
 		"payload":    message,
 		"request_id": request.FromContext(ctx),
 	}
-	_, err := self.client.Upsert(
-		bson.M{"chat_id": chatId},
-		bson.M{
-			"$set":  bson.M{"chat_id": chatId},
-			"$push": bson.M{"msgs": messageEnvelope},
+	err := withSession(self.client, func(collection *mgo.Collection) error {
+		return mongo.Retry(ctx, collection.Database.Session, &self.settings.DatabaseSettings, func(attempt int) error {
+			return pushMessage(collection, chatId, messageId, messageEnvelope)
 		})
+	})
 	return errors.Wrap(err, "add message to the queue")
 }
 
-func (self *MongoWriter) CreateIndexes() error {
-	var err error
-
-	err = self.client.EnsureIndex(mgo.Index{Key: []string{"chat_id"}, Unique: true})
-	if err != nil {
-		return errors.Wrap(err, "unique key: chat_id")
+// pushMessage is idempotent thanks to the message id: if the message is already pushed,
+// the selector doesn't match and the upsert fails on the unique chat_id index.
+// The same error means a concurrent writer has just created the chat document, then the upsert is repeated.
+func pushMessage(collection *mgo.Collection, chatId int, messageId string, messageEnvelope interface{}) error {
+	for {
+		_, err := collection.Upsert(
+			bson.M{"chat_id": chatId, "msgs.id": bson.M{"$ne": messageId}},
+			bson.M{
+				"$set":  bson.M{"chat_id": chatId},
+				"$push": bson.M{"msgs": messageEnvelope},
+			})
+		if index, ok := mongo.DuplicateKeyIndex(err); !ok || index != "chat_id_1" {
+			return err
+		}
+		n, err := collection.Find(bson.M{"chat_id": chatId, "msgs.id": messageId}).Count()
+		if err != nil || n != 0 {
+			return errors.Wrap(err, "check pushed message")
+		}
 	}
+}
 
-	return nil
+func (self *MongoWriter) CreateIndexes() error {
+	_, err := mongo.SyncIndexes(self.client, Indexes, mongo.IndexSyncOptions{})
+	return err
 }
 
 type Document struct {
 	ChatID int `bson:"chat_id"`
 	Msgs   []*struct {
+		Id        string      `bson:"id"`
 		CreatedAt int         `bson:"created_at"`
 		Payload   interface{} `bson:"payload"`
 		RequestId string      `bson:"request_id"`
@@ -82,33 +117,43 @@ func (self ReadyMessage) String() string {
 
 type MongoReader struct {
 	*logging.LoggerMixin
-	client *mgo.Collection
+	client   *mgo.Collection
+	settings *utils.MongoDBSettings
 }
 
 func NewMongoReader(settings *utils.MongoDBSettings) (*MongoReader, error) {
-	collection, err := mongo.ConnectCollection(settings)
+	collection, err := mongo.DefaultManager.Collection(context.Background(), settings)
 	if err != nil {
 		return nil, err
 	}
+	mongo.DefaultIndexes.Register(collection, Indexes...)
 	logger := logging.NewLoggerMixin("mongo_queue_reader", nil)
-	return &MongoReader{client: collection, LoggerMixin: logger}, nil
+	return &MongoReader{client: collection, settings: settings, LoggerMixin: logger}, nil
 }
 
 func (self *MongoReader) GetAndRemoveNext(ctx context.Context) (*ReadyMessage, error) {
 	var doc Document
 	currentTime := utils.TimestampMilliseconds()
 	processingID := uuid.NewV4().String()
-	_, err := self.client.Find(
-		bson.M{
-			"$or": []bson.M{
-				{"processing.started_at": bson.M{"$exists": false}},
-				{"processing.started_at": bson.M{"$lt": currentTime - maxProcessingTime}},
-			}}).Sort("msgs.0.created_at").Apply(
-		mgo.Change{Update: bson.M{
-			"$set": bson.M{"processing": bson.M{"started_at": currentTime, "id": processingID}},
-			"$pop": bson.M{"msgs": -1},
-		}},
-		&doc)
+	err := withSession(self.client, func(collection *mgo.Collection) error {
+		return mongo.Retry(ctx, collection.Database.Session, &self.settings.DatabaseSettings, func(attempt int) error {
+			if attempt > 1 {
+				self.releaseLostProcessing(ctx, collection, processingID)
+			}
+			_, err := collection.Find(
+				bson.M{
+					"$or": []bson.M{
+						{"processing.started_at": bson.M{"$exists": false}},
+						{"processing.started_at": bson.M{"$lt": currentTime - maxProcessingTime}},
+					}}).Sort("msgs.0.created_at").Apply(
+				mgo.Change{Update: bson.M{
+					"$set": bson.M{"processing": bson.M{"started_at": currentTime, "id": processingID}},
+					"$pop": bson.M{"msgs": -1},
+				}},
+				&doc)
+			return err
+		})
+	})
 	if err == mgo.ErrNotFound {
 		return nil, nil
 	}
@@ -132,8 +177,29 @@ func (self *MongoReader) GetAndRemoveNext(ctx context.Context) (*ReadyMessage, e
 		ProcessingId: processingID}, nil
 }
 
+// releaseLostProcessing unlocks the chat if a failed attempt was actually applied, its popped message can't be recovered.
+func (self *MongoReader) releaseLostProcessing(ctx context.Context, collection *mgo.Collection, processingID string) {
+	var doc Document
+	err := collection.Find(bson.M{"processing.id": processingID}).One(&doc)
+	if err != nil {
+		return
+	}
+	logger := self.GetLogger(ctx).WithFields(log.Fields{"chat_id": doc.ChatID, "processing_id": processingID})
+	logger.Error("Failed attempt to get next message was applied, the message is lost")
+	err = self.finishProcessing(ctx, collection, processingID)
+	if err != nil {
+		logger.Errorf("Can't release chat processing: %s", err)
+	}
+}
+
 func (self *MongoReader) FinishProcessing(ctx context.Context, processingID string) error {
-	err := self.client.Remove(bson.M{"msgs": []interface{}{}, "processing.id": processingID})
+	return withSession(self.client, func(collection *mgo.Collection) error {
+		return self.finishProcessing(ctx, collection, processingID)
+	})
+}
+
+func (self *MongoReader) finishProcessing(ctx context.Context, collection *mgo.Collection, processingID string) error {
+	err := collection.Remove(bson.M{"msgs": []interface{}{}, "processing.id": processingID})
 	if err != nil && err != mgo.ErrNotFound {
 		return errors.Wrap(err, "remove document after processing")
 	}
@@ -141,7 +207,7 @@ func (self *MongoReader) FinishProcessing(ctx context.Context, processingID stri
 		return nil
 	}
 
-	err = self.client.Update(
+	err = collection.Update(
 		bson.M{"processing.id": processingID},
 		bson.M{"$unset": bson.M{"processing": ""}},
 	)
@@ -154,17 +220,6 @@ func (self *MongoReader) FinishProcessing(ctx context.Context, processingID stri
 }
 
 func (self *MongoReader) CreateIndexes() error {
-	var err error
-
-	err = self.client.EnsureIndex(mgo.Index{Key: []string{"processing.id"}, Unique: true})
-	if err != nil {
-		return errors.Wrap(err, "unique key: processing.id")
-	}
-
-	err = self.client.EnsureIndex(mgo.Index{Key: []string{"processing.started_at", "msgs.0.created_at"}})
-	if err != nil {
-		return errors.Wrap(err, "key: processing.started_at,msgs.0.created_at")
-	}
-
-	return nil
+	_, err := mongo.SyncIndexes(self.client, Indexes, mongo.IndexSyncOptions{})
+	return err
 }
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+)
+
+const (
+	RedactedValue = "******"
+
+	secretTag = "secret"
+)
+
+// RedactSecrets returns a copy of obj where string fields tagged with `secret:"true"` are replaced by RedactedValue
+// and other secret fields are zeroed. obj itself is never modified.
+func RedactSecrets(obj interface{}) interface{} {
+	if obj == nil {
+		return nil
+	}
+	redacted, changed := redactValue(reflect.ValueOf(obj))
+	if !changed {
+		return obj
+	}
+	return redacted.Interface()
+}
+
+func isSecretField(field reflect.StructField) bool {
+	return field.Tag.Get(secretTag) == "true"
+}
+
+func redactValue(value reflect.Value) (reflect.Value, bool) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return value, false
+		}
+		elem, changed := redactValue(value.Elem())
+		if !changed {
+			return value, false
+		}
+		result := reflect.New(elem.Type())
+		result.Elem().Set(elem)
+		return result, true
+	case reflect.Interface:
+		if value.IsNil() {
+			return value, false
+		}
+		elem, changed := redactValue(value.Elem())
+		if !changed {
+			return value, false
+		}
+		result := reflect.New(value.Type()).Elem()
+		result.Set(elem)
+		return result, true
+	case reflect.Struct:
+		return redactStruct(value)
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return value, false
+		}
+		var result reflect.Value
+		for i := 0; i < value.Len(); i++ {
+			elem, changed := redactValue(value.Index(i))
+			if !changed {
+				continue
+			}
+			if !result.IsValid() {
+				result = copyList(value)
+			}
+			result.Index(i).Set(elem)
+		}
+		if !result.IsValid() {
+			return value, false
+		}
+		return result, true
+	case reflect.Map:
+		if value.IsNil() {
+			return value, false
+		}
+		changedAny := false
+		result := reflect.MakeMapWithSize(value.Type(), value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			elem, changed := redactValue(iter.Value())
+			changedAny = changedAny || changed
+			result.SetMapIndex(iter.Key(), elem)
+		}
+		if !changedAny {
+			return value, false
+		}
+		return result, true
+	default:
+		return value, false
+	}
+}
+
+func redactStruct(value reflect.Value) (reflect.Value, bool) {
+	valueType := value.Type()
+	var result reflect.Value
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldValue := value.Field(i)
+		var redacted reflect.Value
+		if isSecretField(field) {
+			if fieldValue.IsZero() {
+				continue
+			}
+			redacted = reflect.New(field.Type).Elem()
+			if field.Type.Kind() == reflect.String {
+				redacted.SetString(RedactedValue)
+			}
+		} else {
+			var changed bool
+			redacted, changed = redactValue(fieldValue)
+			if !changed {
+				continue
+			}
+		}
+		if !result.IsValid() {
+			result = reflect.New(valueType).Elem()
+			result.Set(value)
+		}
+		result.Field(i).Set(redacted)
+	}
+	if !result.IsValid() {
+		return value, false
+	}
+	return result, true
+}
+
+func copyList(value reflect.Value) reflect.Value {
+	if value.Kind() == reflect.Array {
+		result := reflect.New(value.Type()).Elem()
+		result.Set(value)
+		return result
+	}
+	result := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+	reflect.Copy(result, value)
+	return result
+}
+
+func configSecretPaths(t reflect.Type, keyPath string, result map[string]bool, visiting map[reflect.Type]bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline, skip := configFieldName(field)
+		if skip {
+			continue
+		}
+		fieldPath := keyPath
+		if !inline {
+			fieldPath = joinKeyPath(keyPath, name)
+		}
+		if isSecretField(field) {
+			result[fieldPath] = true
+			continue
+		}
+		configSecretPaths(field.Type, fieldPath, result, visiting)
+	}
+}
+
+func markSecretKeys(data map[string]interface{}, keys []string, secrets map[string]bool) {
+	for _, key := range keys {
+		value, ok := lookupConfigValue(data, strings.Split(key, "."))
+		if !ok {
+			continue
+		}
+		if section, isMap := value.(map[string]interface{}); isMap {
+			leaves := map[string]interface{}{}
+			flattenConfigData(section, key, leaves)
+			for leaf := range leaves {
+				secrets[leaf] = true
+			}
+			continue
+		}
+		secrets[key] = true
+	}
+}
@@ -46,7 +46,7 @@ func SplitWords(text string) []string {
 }
 
 func ObjToString(obj interface{}) string {
-	b, err := json.Marshal(obj)
+	b, err := json.Marshal(RedactSecrets(obj))
 	if err != nil {
 		return fmt.Sprintf("cannot represent as json: %s", err)
 	}